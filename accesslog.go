@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access logs: one record per request, written to -access_log (JSON lines or
+// S3 server access log format) and, for buckets with logging enabled by
+// PutBucketLogging, delivered as log objects (S3 format) into the target
+// bucket every -access_log_delivery.
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/LogFormat.html
+
+const (
+	accessLogFormatJSON = "json"
+	accessLogFormatS3   = "s3"
+)
+
+var (
+	accessLogPath     string // "" disables, "-" is stdout
+	accessLogFormat   string
+	accessLogDelivery time.Duration
+
+	accessLogMu  sync.Mutex
+	accessLogOut io.Writer
+)
+
+func isValidAccessLogFormat(format string) bool {
+	return format == accessLogFormatJSON || format == accessLogFormatS3
+}
+
+type accessLogRecord struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"requestId"`
+	HostID         string    `json:"hostId"`
+	RemoteIP       string    `json:"remoteIp"`
+	Requester      string    `json:"requester,omitempty"`
+	BucketOwner    string    `json:"bucketOwner,omitempty"`
+	Bucket         string    `json:"bucket,omitempty"`
+	Key            string    `json:"key,omitempty"`
+	Operation      string    `json:"operation"`
+	RequestURI     string    `json:"requestUri"`
+	Status         int       `json:"status"`
+	ErrorCode      string    `json:"errorCode,omitempty"`
+	BytesSent      int64     `json:"bytesSent"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	TotalTime      int64     `json:"totalTimeMs"`
+	TurnaroundTime int64     `json:"turnaroundTimeMs"`
+	Referer        string    `json:"referer,omitempty"`
+	UserAgent      string    `json:"userAgent,omitempty"`
+	Host           string    `json:"host"`
+	TLSVersion     string    `json:"tlsVersion,omitempty"`
+	CipherSuite    string    `json:"cipherSuite,omitempty"`
+}
+
+// openAccessLog opens -access_log for appending
+func openAccessLog() error {
+	switch accessLogPath {
+	case "":
+		return nil
+	case "-":
+		accessLogOut = os.Stdout
+		return nil
+	}
+
+	file, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	accessLogOut = file
+	return nil
+}
+
+// flushAccessLogs delivers queued records into target buckets and closes
+// -access_log (on shutdown)
+func flushAccessLogs() {
+	if accessLogDelivery > 0 {
+		deliverLogs()
+	}
+
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	if file, ok := accessLogOut.(*os.File); ok && file != os.Stdout {
+		if err := file.Close(); err != nil {
+			log.Printf("Error closing access log : %s", err)
+		}
+	}
+	accessLogOut = nil
+}
+
+// s3Operation names the request like S3 access logs do (REST.GET.OBJECT etc.)
+func s3Operation(r *http.Request) string {
+	bucketName, objectKey, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	method := r.Method
+	if method == http.MethodOptions {
+		return "REST.OPTIONS.PREFLIGHT"
+	}
+
+	if bucketName == "" {
+		return "REST." + method + ".SERVICE"
+	}
+
+	if objectKey == "" {
+		for _, sub := range []struct{ query, name string }{
+			{"location", "LOCATION"},
+			{"cors", "CORS"},
+			{"lifecycle", "LIFECYCLE"},
+			{"tagging", "TAGGING"},
+			{"encryption", "ENCRYPTION"},
+			{"object-lock", "OBJECT_LOCK_CONFIGURATION"},
+			{"logging", "LOGGING_STATUS"},
+			{"uploads", "UPLOADS"},
+		} {
+			if query.Has(sub.query) {
+				return "REST." + method + "." + sub.name
+			}
+		}
+		return "REST." + method + ".BUCKET"
+	}
+
+	for _, sub := range []struct{ query, name string }{
+		{"tagging", "OBJECT_TAGGING"},
+		{"retention", "RETENTION"},
+		{"legal-hold", "LEGAL_HOLD"},
+		{"attributes", "OBJECT_ATTRIBUTES"},
+		{"uploads", "UPLOADS"},
+	} {
+		if query.Has(sub.query) {
+			return "REST." + method + "." + sub.name
+		}
+	}
+
+	if r.Header.Get("x-amz-copy-source") != "" {
+		if query.Has("partNumber") {
+			return "REST.COPY.PART"
+		}
+		return "REST.COPY.OBJECT"
+	}
+
+	if query.Has("uploadId") {
+		if method == http.MethodPut {
+			return "REST.PUT.PART"
+		}
+		return "REST." + method + ".UPLOAD"
+	}
+
+	return "REST." + method + ".OBJECT"
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func newAccessLogRecord(w *requestWriter) *accessLogRecord {
+	r := w.r
+	end := time.Now()
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	// turnaround: from the last byte of the request to the first byte of the response
+	turnaround := int64(0)
+	if !w.firstByte.IsZero() {
+		received := w.start
+		if w.body != nil && w.body.done.After(received) {
+			received = w.body.done
+		}
+		turnaround = max(w.firstByte.Sub(received).Milliseconds(), 0)
+	}
+
+	bucketName, objectKey, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	record := &accessLogRecord{
+		Time:           w.start.UTC(),
+		RequestID:      w.requestID,
+		HostID:         w.hostID,
+		RemoteIP:       remoteIP(r),
+		Requester:      w.requester,
+		Bucket:         bucketName,
+		Key:            objectKey,
+		Operation:      s3Operation(r),
+		RequestURI:     r.Method + " " + r.RequestURI + " " + r.Proto,
+		Status:         status,
+		ErrorCode:      w.errorCode,
+		BytesSent:      w.bytesSent,
+		BytesReceived:  w.bytesReceived(),
+		TotalTime:      end.Sub(w.start).Milliseconds(),
+		TurnaroundTime: turnaround,
+		Referer:        r.Referer(),
+		UserAgent:      r.UserAgent(),
+		Host:           r.Host,
+	}
+	if r.TLS != nil {
+		record.TLSVersion = tls.VersionName(r.TLS.Version)
+		record.CipherSuite = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	return record
+}
+
+func logField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func logQuoted(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// s3Format formats record as a line of S3 server access log
+func (rec *accessLogRecord) s3Format() string {
+	bytesSent := "-"
+	if rec.BytesSent > 0 {
+		bytesSent = fmt.Sprint(rec.BytesSent)
+	}
+	signature, auth := "-", "-"
+	if rec.Requester != "" {
+		signature, auth = "SigV4", "AuthHeader"
+	}
+	tlsVersion := rec.TLSVersion
+	if tlsVersion != "" {
+		tlsVersion = strings.ToUpper(strings.ReplaceAll(tlsVersion, " ", ""))
+	}
+
+	return strings.Join([]string{
+		logField(rec.BucketOwner),
+		logField(rec.Bucket),
+		rec.Time.Format("[02/Jan/2006:15:04:05 -0700]"),
+		logField(rec.RemoteIP),
+		logField(rec.Requester),
+		rec.RequestID,
+		rec.Operation,
+		logField(rec.Key),
+		logQuoted(rec.RequestURI),
+		fmt.Sprint(rec.Status),
+		logField(rec.ErrorCode),
+		bytesSent,
+		"-", // object size
+		fmt.Sprint(rec.TotalTime),
+		fmt.Sprint(rec.TurnaroundTime),
+		logQuoted(rec.Referer),
+		logQuoted(rec.UserAgent),
+		"-", // version id
+		rec.HostID,
+		signature,
+		logField(rec.CipherSuite),
+		auth,
+		logField(rec.Host),
+		logField(tlsVersion),
+		"-", // access point ARN
+		"-", // ACL required
+	}, " ")
+}
+
+// logAccess writes access log record of the request answered through w
+func logAccess(w *requestWriter) {
+	record := newAccessLogRecord(w)
+
+	var logging *XmlLoggingEnabled
+	if record.Bucket != "" && isSafeBucketName(record.Bucket) {
+		meta := loadBucketMeta(record.Bucket)
+		record.BucketOwner = meta.Owner
+		logging = meta.Logging
+	}
+
+	if accessLogOut != nil {
+		var line string
+		if accessLogFormat == accessLogFormatJSON {
+			data, err := json.Marshal(record)
+			if err != nil {
+				log.Printf("Error formatting access log record : %s", err)
+				return
+			}
+			line = string(data)
+		} else {
+			line = record.s3Format()
+		}
+
+		var err error
+		accessLogMu.Lock()
+		if accessLogOut != nil { // closed by shutdown meanwhile
+			_, err = io.WriteString(accessLogOut, line+"\n")
+		}
+		accessLogMu.Unlock()
+		if err != nil {
+			log.Printf("Error writing access log : %s", err)
+		}
+	}
+
+	// nothing drains the queue when delivery is disabled
+	if logging != nil && accessLogDelivery > 0 {
+		queueLogDelivery(record.Bucket, record.s3Format())
+	}
+}
+
+// records waiting for delivery into target buckets, by source bucket
+var logDelivery = struct {
+	sync.Mutex
+	pending map[string][]string
+}{pending: map[string][]string{}}
+
+func queueLogDelivery(bucketName string, line string) {
+	logDelivery.Lock()
+	logDelivery.pending[bucketName] = append(logDelivery.pending[bucketName], line)
+	logDelivery.Unlock()
+}
+
+// startLogDeliveryWorker delivers queued records periodically
+func startLogDeliveryWorker() {
+	if accessLogDelivery <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(accessLogDelivery)
+			deliverLogs()
+		}
+	}()
+}
+
+// deliverLogs writes queued records of every source bucket as a log object
+// <TargetPrefix>YYYY-mm-DD-HH-MM-SS-<random> into its target bucket
+func deliverLogs() {
+	logDelivery.Lock()
+	pending := logDelivery.pending
+	logDelivery.pending = map[string][]string{}
+	logDelivery.Unlock()
+
+	for bucketName, lines := range pending {
+		logging := loadBucketMeta(bucketName).Logging
+		if logging == nil {
+			continue
+		}
+
+		suffix := make([]byte, 8)
+		rand.Read(suffix)
+		objectKey := logging.TargetPrefix + time.Now().UTC().Format("2006-01-02-15-04-05") + "-" + strings.ToUpper(hex.EncodeToString(suffix))
+
+		data := []byte(strings.Join(lines, "\n") + "\n")
+		if err := writeLogObject(logging.TargetBucket, objectKey, data); err != nil {
+			log.Printf("Error delivering %d access log records of %s to %s/%s : %s", len(lines), bucketName, logging.TargetBucket, objectKey, err)
+		}
+	}
+}
+
+// writeLogObject stores log object like PutObject would (encrypted if the
+// target bucket has default encryption)
+func writeLogObject(bucketName string, objectKey string, data []byte) error {
+	if _, err := os.Stat(bucketDir(bucketName)); err != nil {
+		return err
+	}
+
+	filePath, code := resolveObjectPath(bucketName, objectKey)
+	if code == ErrNone {
+		code = prepareObjectDirs(bucketName, filePath)
+	}
+	if code != ErrNone {
+		return fmt.Errorf("invalid log object key (%s)", GetAPIError(code).Code)
+	}
+
+	var enc *ObjectEncryption
+	var dataKey []byte
+	if config := loadBucketMeta(bucketName).Encryption; config != nil && sseEnabled() {
+		var err error
+		if enc, dataKey, err = newObjectEncryption(); err != nil {
+			return err
+		}
+		enc.Size = int64(len(data))
+	}
+
+	file, err := createTempFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	if enc != nil {
+		var encrypter *sseWriter
+		if encrypter, err = newSSEWriter(file, dataKey); err == nil {
+			if _, err = encrypter.Write(data); err == nil {
+				err = encrypter.Close()
+			}
+		}
+	} else {
+		_, err = file.Write(data)
+	}
+	if err != nil {
+		discardTempFile(file)
+		return err
+	}
+
+	unlock := objectLocks.Lock(bucketName, objectKey)
+	defer unlock()
+
+	if filePath, code = objectWritePath(filePath); code != ErrNone {
+		discardTempFile(file)
+		return fmt.Errorf("invalid log object key (%s)", GetAPIError(code).Code)
+	}
+	sum := md5.Sum(data)
+	meta := ObjectMeta{ETag: hex.EncodeToString(sum[:]), Encryption: enc}
+	_, err = commitObject(file, filePath, bucketName, objectKey, &meta)
+	return err
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_LoggingEnabled.html
+type XmlLoggingEnabled struct {
+	TargetBucket string `xml:"TargetBucket" json:"targetBucket"`
+	TargetPrefix string `xml:"TargetPrefix" json:"targetPrefix"`
+}
+
+type XmlBucketLoggingStatus struct {
+	XMLName        xml.Name           `xml:"BucketLoggingStatus"`
+	Xmlns          string             `xml:"xmlns,attr,omitempty"`
+	LoggingEnabled *XmlLoggingEnabled `xml:"LoggingEnabled"`
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketLogging.html
+func putBucketLogging(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var status XmlBucketLoggingStatus
+	if err = xml.Unmarshal(body, &status); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	// empty BucketLoggingStatus disables logging
+	if logging := status.LoggingEnabled; logging != nil {
+		if !isSafeBucketName(logging.TargetBucket) {
+			s3err(w, ErrInvalidTargetBucketForLogging)
+			return nil
+		}
+		if _, err := os.Stat(bucketDir(logging.TargetBucket)); err != nil {
+			s3err(w, ErrInvalidTargetBucketForLogging)
+			return nil
+		}
+		if _, code := resolveObjectPath(logging.TargetBucket, logging.TargetPrefix+"x"); code != ErrNone {
+			s3err(w, ErrInvalidArgument)
+			return nil
+		}
+		// logs are written on behalf of the requester
+		if !isRequestAllowed(r, "s3:PutObject", logging.TargetBucket, logging.TargetPrefix) {
+			s3err(w, ErrAccessDenied)
+			return nil
+		}
+	}
+
+	err = updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Logging = status.LoggingEnabled
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving logging configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLogging.html
+func getBucketLogging(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	status := XmlBucketLoggingStatus{
+		Xmlns:          "http://s3.amazonaws.com/doc/2006-03-01/",
+		LoggingEnabled: loadBucketMeta(bucketName).Logging,
+	}
+	return writeXML(w, status)
+}
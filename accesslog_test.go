@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBucketLogging = `<BucketLoggingStatus><LoggingEnabled><TargetBucket>%s</TargetBucket>
+<TargetPrefix>logs/</TargetPrefix></LoggingEnabled></BucketLoggingStatus>`
+
+func putTestBucketLogging(id *s3Identity, bucketName string, targetBucket string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	body := strings.Replace(testBucketLogging, "%s", targetBucket, 1)
+	r := withIdentity(httptest.NewRequest(http.MethodPut, "/"+bucketName+"?logging", strings.NewReader(body)), id)
+	putBucketLogging(w, r, bucketName)
+	return w
+}
+
+// logs may only be delivered into buckets the requester may write to
+func TestPutBucketLoggingTarget(t *testing.T) {
+	testStorage(t)
+	if err := os.MkdirAll(bucketDir("other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	id := &s3Identity{AccessKeyId: "ci", Policy: testPolicy(t, `{"Statement": [
+		{"Effect": "Allow", "Action": "s3:*", "Resource": ["arn:aws:s3:::bkt", "arn:aws:s3:::bkt/*"]}
+	]}`)}
+
+	if w := putTestBucketLogging(id, "bkt", "other"); w.Code != http.StatusForbidden {
+		t.Errorf("logging into bucket of others : %d %s", w.Code, w.Body)
+	}
+	if loadBucketMeta("bkt").Logging != nil {
+		t.Errorf("rejected logging configuration was stored")
+	}
+	if w := putTestBucketLogging(id, "bkt", "bkt"); w.Code != http.StatusOK {
+		t.Errorf("logging into own bucket : %d %s", w.Code, w.Body)
+	}
+}
+
+// with delivery disabled records must not pile up in memory
+func TestAccessLogDeliveryDisabled(t *testing.T) {
+	testStorage(t)
+	defer func(delivery time.Duration) { accessLogDelivery = delivery }(accessLogDelivery)
+	accessLogDelivery = 0
+
+	if w := putTestBucketLogging(nil, "bkt", "bkt"); w.Code != http.StatusOK {
+		t.Fatalf("PutBucketLogging : %d %s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/bkt/key", nil)
+	logAccess(&requestWriter{ResponseWriter: httptest.NewRecorder(), r: r, start: time.Now()})
+
+	logDelivery.Lock()
+	defer logDelivery.Unlock()
+	if n := len(logDelivery.pending["bkt"]); n != 0 {
+		t.Errorf("%d records queued for delivery", n)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+// Endpoints of the admin listener besides /metrics:
+//   /healthz      - process is up
+//   /readyz       - data dirs are writable and have enough free space
+//   /admin/info   - version, uptime, configuration and storage usage (admin credential)
+//   /debug/pprof/ - Go profiler (admin credential)
+// Admin credential is the access key id/secret key of an admin user sent as
+// HTTP basic auth.
+
+var (
+	version      = "" // set at build time with -ldflags "-X main.version=..."
+	startTime    = time.Now()
+	readyMinFree int64 // MiB
+)
+
+const redactedValue = "REDACTED"
+
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+		if info.Main.Version != "" {
+			return info.Main.Version
+		}
+	}
+	return "unknown"
+}
+
+// requireAdmin wraps admin-only handlers with basic auth against admin identities
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accessKeyId, secret, ok := r.BasicAuth()
+		id := lookupIdentity(accessKeyId)
+		if !ok || id == nil || !id.Admin ||
+			subtle.ConstantTimeCompare([]byte(secret), []byte(id.SecretAccessKey)) != 1 {
+			metricAuthFailures.add(metricLabels("reason", "admin_endpoint"), 1)
+			w.Header().Set("WWW-Authenticate", `Basic realm="gos3rve admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// diskSpace returns total and available bytes of the filesystem holding path
+func diskSpace(path string) (total uint64, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// checkDirReady checks that a file can be created in dir and that it has enough free space
+func checkDirReady(dir string) error {
+	file, err := os.CreateTemp(dir, ".gos3rve-ready-*")
+	if err != nil {
+		return fmt.Errorf("not writable : %w", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	_, avail, err := diskSpace(dir)
+	if err != nil {
+		return err
+	}
+	if avail < uint64(readyMinFree)<<20 {
+		return fmt.Errorf("only %d MiB free (need %d MiB)", avail>>20, readyMinFree)
+	}
+	return nil
+}
+
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	result := ""
+	for _, dir := range []string{bucketPath, uploadsPath, metaPath} {
+		if err := checkDirReady(dir); err != nil {
+			ready = false
+			result += fmt.Sprintf("%s: %s\n", dir, err)
+		} else {
+			result += fmt.Sprintf("%s: ok\n", dir)
+		}
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, result)
+}
+
+type adminDirInfo struct {
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+type adminUserInfo struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Admin           bool   `json:"admin"`
+	Policy          bool   `json:"policy"`
+}
+
+type adminInfo struct {
+	Version       string                 `json:"version"`
+	GoVersion     string                 `json:"go_version"`
+	StartTime     time.Time              `json:"start_time"`
+	UptimeSeconds int64                  `json:"uptime_seconds"`
+	Config        map[string]interface{} `json:"config"`
+	Users         []adminUserInfo        `json:"users"`
+	Storage       []adminDirInfo         `json:"storage"`
+	Buckets       map[string]bucketUsage `json:"buckets"`
+	BucketsAt     time.Time              `json:"buckets_computed_at"`
+}
+
+// effectiveConfig returns settings the server runs with, secrets redacted
+func effectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"port":                svcPort,
+		"tls_port":            tlsPort,
+		"tls_cert":            tlsCertPath,
+		"tls_key":             tlsKeyPath,
+		"tls_client_ca":       tlsClientCAPath,
+		"admin_port":          adminPort,
+		"region":              s3region,
+		"dir_buckets":         bucketPath,
+		"dir_uploads":         uploadsPath,
+		"dir_meta":            metaPath,
+		"durability":          durability,
+		"key_encoding":        keyEncoding,
+		"vhost_domains":       vhostDomains,
+		"lifecycle_interval":  lifecycleInterval.String(),
+		"metrics_interval":    metricsScanInterval.String(),
+		"sse_master_key":      sseMasterKeyPath,
+		"ssec_allow_http":     ssecAllowHTTP,
+		"access_log":          accessLogPath,
+		"access_log_format":   accessLogFormat,
+		"access_log_delivery": accessLogDelivery.String(),
+		"ready_min_free_mb":   readyMinFree,
+		"shutdown_timeout":    shutdownTimeout.String(),
+		"max_object_size":     objectSizeLimit(),
+		"max_header_size":     int64(maxHeaderSize),
+		"config":              cfgPath,
+		"user_name":           s3user,
+		"user_id":             userId,
+	}
+}
+
+func serveAdminInfo(w http.ResponseWriter, r *http.Request) {
+	info := adminInfo{
+		Version:       buildVersion(),
+		GoVersion:     runtime.Version(),
+		StartTime:     startTime.UTC(),
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Config:        effectiveConfig(),
+	}
+
+	for _, id := range allIdentities() {
+		info.Users = append(info.Users, adminUserInfo{
+			AccessKeyId:     id.AccessKeyId,
+			SecretAccessKey: redactedValue,
+			Admin:           id.Admin,
+			Policy:          id.Policy != nil,
+		})
+	}
+
+	for _, dir := range []string{bucketPath, uploadsPath, metaPath} {
+		dirInfo := adminDirInfo{Path: dir}
+		var err error
+		if dirInfo.TotalBytes, dirInfo.FreeBytes, err = diskSpace(dir); err != nil {
+			dirInfo.Error = err.Error()
+		}
+		info.Storage = append(info.Storage, dirInfo)
+	}
+
+	info.Buckets, info.BucketsAt = lastBucketUsage()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(info)
+}
+
+func registerAdminEndpoints() {
+	adminMux.HandleFunc("/healthz", serveHealthz)
+	adminMux.HandleFunc("/readyz", serveReadyz)
+	adminMux.HandleFunc("/admin/info", requireAdmin(serveAdminInfo))
+	adminMux.HandleFunc("/debug/pprof/", requireAdmin(pprof.Index))
+	adminMux.HandleFunc("/debug/pprof/cmdline", requireAdmin(pprof.Cmdline))
+	adminMux.HandleFunc("/debug/pprof/profile", requireAdmin(pprof.Profile))
+	adminMux.HandleFunc("/debug/pprof/symbol", requireAdmin(pprof.Symbol))
+	adminMux.HandleFunc("/debug/pprof/trace", requireAdmin(pprof.Trace))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Durability levels (-durability flag) - which fsync calls are made when an
+// object is committed
+const (
+	durabilityNone = "none" // rely on the OS to flush data eventually
+	durabilityFile = "file" // fsync data file before it replaces the destination
+	durabilityFull = "full" // fsync data file and its parent directory after rename
+)
+
+// tmpFilePrefix marks in-flight writes. Such files live next to their
+// destination (rename must not cross filesystems) and are hidden from listings.
+const tmpFilePrefix = ".gos3rve-tmp-"
+
+var durability string
+
+func isValidDurability(level string) bool {
+	return level == durabilityNone || level == durabilityFile || level == durabilityFull
+}
+
+// isTempFile reports whether directory entry is an in-flight write
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tmpFilePrefix)
+}
+
+// createTempFile creates temp file in the directory of dstPath (parent
+// directories are created as needed). Data is written there and later
+// moved over dstPath by commitTempFile.
+func createTempFile(dstPath string) (*os.File, error) {
+	dirPath := filepath.Dir(dstPath)
+
+	// directory may be pruned by a concurrent delete between the two calls
+	var file *os.File
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = os.MkdirAll(dirPath, 0755); err != nil {
+			return nil, err
+		}
+		if file, err = os.CreateTemp(dirPath, tmpFilePrefix); !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = file.Chmod(0644); err != nil {
+		discardTempFile(file)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// discardTempFile closes and removes temp file. Destination is left untouched.
+func discardTempFile(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing temp file %s : %s\n", file.Name(), err)
+	}
+}
+
+// commitTempFile atomically replaces dstPath with the content of temp file.
+// Readers either see previous version of dstPath or the new one, never
+// a partially written file. The temp file is closed (and removed on failure).
+func commitTempFile(file *os.File, dstPath string) error {
+	if durability != durabilityNone {
+		if err := file.Sync(); err != nil {
+			discardTempFile(file)
+			return fmt.Errorf("fsync %s : %w", file.Name(), err)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := os.Rename(file.Name(), dstPath); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if durability == durabilityFull {
+		if err := syncDir(filepath.Dir(dstPath)); err != nil {
+			return fmt.Errorf("fsync dir of %s : %w", dstPath, err)
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic is os.WriteFile counterpart using temp file + rename
+func writeFileAtomic(path string, data []byte) error {
+	file, err := createTempFile(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err != nil {
+		discardTempFile(file)
+		return err
+	}
+
+	return commitTempFile(file, path)
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
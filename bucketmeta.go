@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BucketMeta is the record of bucket settings. It lives next to the metadata
+// of bucket's objects in dir_meta and goes away with the bucket.
+type BucketMeta struct {
+	Created   time.Time                  `json:"created"`
+	Owner     string                     `json:"owner,omitempty"` // access key id of the creator
+	Region    string                     `json:"region,omitempty"`
+	Tags      map[string]string          `json:"tags,omitempty"`
+	CORS      *XmlCORSConfiguration      `json:"cors,omitempty"`
+	Lifecycle *XmlLifecycleConfiguration `json:"lifecycle,omitempty"`
+
+	ObjectLock *XmlObjectLockConfiguration `json:"objectLock,omitempty"`
+	Encryption *XmlSSEConfiguration        `json:"encryption,omitempty"`
+	Logging    *XmlLoggingEnabled          `json:"logging,omitempty"`
+}
+
+// serialises read-modify-write cycles of bucket records
+var bucketMetaLock sync.Mutex
+
+func bucketMetaPath(bucketName string) string {
+	return filepath.Join(metaPath, bucketName, "bucket.json")
+}
+
+// loadBucketMeta returns bucket record, buckets created by older versions
+// of the server (or by hand) get an empty one
+func loadBucketMeta(bucketName string) *BucketMeta {
+	var meta BucketMeta
+
+	data, err := os.ReadFile(bucketMetaPath(bucketName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading metadata of bucket %s : %s\n", bucketName, err)
+		}
+		return &meta
+	}
+
+	if err = json.Unmarshal(data, &meta); err != nil {
+		log.Printf("Ignoring corrupted metadata of bucket %s : %s\n", bucketName, err)
+		return &BucketMeta{}
+	}
+
+	return &meta
+}
+
+func saveBucketMeta(bucketName string, meta *BucketMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bucketMetaPath(bucketName), data)
+}
+
+// updateBucketMeta applies update to the bucket record and saves it
+func updateBucketMeta(bucketName string, update func(meta *BucketMeta)) error {
+	bucketMetaLock.Lock()
+	defer bucketMetaLock.Unlock()
+
+	meta := loadBucketMeta(bucketName)
+	update(meta)
+	return saveBucketMeta(bucketName, meta)
+}
+
+// bucketRegion returns region bucket was created in
+func bucketRegion(bucketName string) string {
+	if region := loadBucketMeta(bucketName).Region; region != "" {
+		return region
+	}
+	return s3region
+}
+
+// bucketCreationDate returns creation time of the bucket. Buckets without
+// one in their record get the mtime of their directory, which is then stored
+// so that it does not change as objects are added.
+func bucketCreationDate(bucketName string, info os.FileInfo) time.Time {
+	if created := loadBucketMeta(bucketName).Created; !created.IsZero() {
+		return created
+	}
+
+	created := info.ModTime().UTC()
+	if !isSafeBucketName(bucketName) {
+		return created
+	}
+	err := updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		if meta.Created.IsZero() {
+			meta.Created = created
+		}
+		created = meta.Created
+	})
+	if err != nil {
+		log.Printf("Error saving creation date of bucket %s : %s\n", bucketName, err)
+	}
+	return created
+}
+
+// bucket sub-resources with their own configuration (PUT /{bucket}?<name>)
+var bucketSubresources = []string{"cors", "lifecycle", "tagging", "object-lock", "encryption", "logging"}
+
+func isBucketSubresourceRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, name := range bucketSubresources {
+		if query.Has(name) {
+			return true
+		}
+	}
+	return false
+}
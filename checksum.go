@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Additional checksum algorithms
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html
+const (
+	checksumCRC32     = "CRC32"
+	checksumCRC32C    = "CRC32C"
+	checksumCRC64NVME = "CRC64NVME"
+	checksumSHA1      = "SHA1"
+	checksumSHA256    = "SHA256"
+
+	checksumTypeFullObject = "FULL_OBJECT"
+	checksumTypeComposite  = "COMPOSITE"
+)
+
+var crc64NVMETable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	checksumCRC32:     func() hash.Hash { return crc32.NewIEEE() },
+	checksumCRC32C:    func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	checksumCRC64NVME: func() hash.Hash { return crc64.New(crc64NVMETable) },
+	checksumSHA1:      sha1.New,
+	checksumSHA256:    sha256.New,
+}
+
+// checksumHeader returns name of the header carrying checksum of given algorithm
+// i.e. "x-amz-checksum-crc32"
+func checksumHeader(algorithm string) string {
+	return "x-amz-checksum-" + strings.ToLower(algorithm)
+}
+
+func isChecksumModeEnabled(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("x-amz-checksum-mode"), "ENABLED")
+}
+
+// XmlChecksums holds Checksum<ALGORITHM> elements used by several S3 responses
+// (CompleteMultipartUpload parts and result, GetObjectAttributes)
+type XmlChecksums struct {
+	ChecksumCRC32     string `xml:"ChecksumCRC32,omitempty"`
+	ChecksumCRC32C    string `xml:"ChecksumCRC32C,omitempty"`
+	ChecksumCRC64NVME string `xml:"ChecksumCRC64NVME,omitempty"`
+	ChecksumSHA1      string `xml:"ChecksumSHA1,omitempty"`
+	ChecksumSHA256    string `xml:"ChecksumSHA256,omitempty"`
+}
+
+func (c *XmlChecksums) field(algorithm string) *string {
+	switch algorithm {
+	case checksumCRC32:
+		return &c.ChecksumCRC32
+	case checksumCRC32C:
+		return &c.ChecksumCRC32C
+	case checksumCRC64NVME:
+		return &c.ChecksumCRC64NVME
+	case checksumSHA1:
+		return &c.ChecksumSHA1
+	case checksumSHA256:
+		return &c.ChecksumSHA256
+	}
+	return nil
+}
+
+// Get returns checksum of given algorithm ("" if not set)
+func (c *XmlChecksums) Get(algorithm string) string {
+	if f := c.field(algorithm); f != nil {
+		return *f
+	}
+	return ""
+}
+
+// Set stores checksum of given algorithm (unknown algorithms are ignored)
+func (c *XmlChecksums) Set(algorithm string, value string) {
+	if f := c.field(algorithm); f != nil {
+		*f = value
+	}
+}
+
+// checksumRequest describes checksum the client asked us to calculate/verify
+type checksumRequest struct {
+	algorithm string // one of checksumAlgorithms keys, "" if none requested
+	expected  string // base64 value sent in header, "" if none (yet)
+	trailer   string // name of aws-chunked trailer carrying the value
+}
+
+// parseChecksumRequest inspects x-amz-checksum-*, x-amz-sdk-checksum-algorithm
+// and x-amz-trailer headers
+func parseChecksumRequest(r *http.Request) (req checksumRequest, code ErrorCode) {
+	for algorithm := range checksumAlgorithms {
+		value := r.Header.Get(checksumHeader(algorithm))
+		if value == "" {
+			continue
+		}
+		if req.algorithm != "" {
+			// only one checksum per request is allowed
+			return req, ErrInvalidRequest
+		}
+		req.algorithm, req.expected = algorithm, value
+	}
+
+	if trailer := strings.ToLower(strings.TrimSpace(r.Header.Get("x-amz-trailer"))); trailer != "" {
+		algorithm := strings.ToUpper(strings.TrimPrefix(trailer, "x-amz-checksum-"))
+		if _, ok := checksumAlgorithms[algorithm]; !ok || req.algorithm != "" {
+			return req, ErrInvalidRequest
+		}
+		req.algorithm, req.trailer = algorithm, trailer
+	}
+
+	if sdkAlgorithm := strings.ToUpper(r.Header.Get("x-amz-sdk-checksum-algorithm")); sdkAlgorithm != "" {
+		if _, ok := checksumAlgorithms[sdkAlgorithm]; !ok {
+			return req, ErrInvalidRequest
+		}
+		if req.algorithm != "" && req.algorithm != sdkAlgorithm {
+			return req, ErrInvalidRequest
+		}
+		req.algorithm = sdkAlgorithm
+	}
+
+	return req, ErrNone
+}
+
+// parseChecksumType validates algorithm/type pair requested for a multipart upload
+// and fills in defaults. Uploads w/o explicit algorithm get CRC64NVME like in S3.
+func parseChecksumType(algorithm string, checksumType string) (string, string, ErrorCode) {
+	algorithm = strings.ToUpper(algorithm)
+	checksumType = strings.ToUpper(checksumType)
+
+	if algorithm == "" {
+		if checksumType != "" {
+			return "", "", ErrInvalidRequest
+		}
+		return checksumCRC64NVME, checksumTypeFullObject, ErrNone
+	}
+
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", "", ErrInvalidRequest
+	}
+
+	switch algorithm {
+	case checksumCRC64NVME:
+		if checksumType == "" || checksumType == checksumTypeFullObject {
+			return algorithm, checksumTypeFullObject, ErrNone
+		}
+	case checksumCRC32, checksumCRC32C:
+		if checksumType == "" || checksumType == checksumTypeComposite || checksumType == checksumTypeFullObject {
+			if checksumType == "" {
+				checksumType = checksumTypeComposite
+			}
+			return algorithm, checksumType, ErrNone
+		}
+	default:
+		if checksumType == "" || checksumType == checksumTypeComposite {
+			return algorithm, checksumTypeComposite, ErrNone
+		}
+	}
+
+	return "", "", ErrInvalidRequest
+}
+
+// compositeChecksum calculates checksum of checksums of the parts the way S3
+// does for COMPOSITE multipart checksums: base64(hash(raw sums)) + "-<parts>"
+func compositeChecksum(algorithm string, partChecksums []string) (string, error) {
+	h := checksumAlgorithms[algorithm]()
+	for _, sum := range partChecksums {
+		raw, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			return "", err
+		}
+		h.Write(raw)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(partChecksums)), nil
+}
+
+func isAWSChunked(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") ||
+		strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-")
+}
+
+// awsChunkedReader decodes aws-chunked request body
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+//
+//	<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n ... 0[;chunk-signature=<sig>]\r\n[<trailer>:<value>\r\n]*\r\n
+//
+// Chunk signatures are not verified (neither is payload of regular requests).
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+	trailers  map[string]string
+}
+
+var errMalformedChunk = errors.New("malformed aws-chunked body")
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReaderSize(r, 64*1024), trailers: make(map[string]string)}
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return "", io.EOF
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	sizeStr, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+	if err != nil || size < 0 {
+		return errMalformedChunk
+	}
+
+	if size > 0 {
+		c.remaining = size
+		return nil
+	}
+
+	// last chunk - read trailers till empty line
+	c.done = true
+	for {
+		line, err := c.readLine()
+		if err == io.EOF || (err == nil && line == "") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return errMalformedChunk
+		}
+		c.trailers[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+
+	if c.remaining == 0 {
+		// chunk data is followed by CRLF
+		if line, err := c.readLine(); err != nil || line != "" {
+			return n, errMalformedChunk
+		}
+		return n, nil
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// checksumVerifier calculates checksum of uploaded data and compares it with
+// the value provided by the client (in header or trailer)
+type checksumVerifier struct {
+	req  checksumRequest
+	hash hash.Hash
+}
+
+func newChecksumVerifier(req checksumRequest) *checksumVerifier {
+	v := &checksumVerifier{req: req}
+	if req.algorithm != "" {
+		v.hash = checksumAlgorithms[req.algorithm]()
+	}
+	return v
+}
+
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	if v.hash == nil {
+		return len(p), nil
+	}
+	return v.hash.Write(p)
+}
+
+// Sum returns base64 encoded checksum ("" if no algorithm selected)
+func (v *checksumVerifier) Sum() string {
+	if v.hash == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(v.hash.Sum(nil))
+}
+
+// Verify compares calculated checksum with the expected one. Trailer values
+// are picked up from the aws-chunked reader (if any).
+func (v *checksumVerifier) Verify(chunked *awsChunkedReader) ErrorCode {
+	expected := v.req.expected
+	if v.req.trailer != "" {
+		if chunked == nil || chunked.trailers[v.req.trailer] == "" {
+			return ErrInvalidRequest
+		}
+		expected = chunked.trailers[v.req.trailer]
+	}
+
+	if expected != "" && expected != v.Sum() {
+		return ErrBadDigest
+	}
+
+	return ErrNone
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings come from (highest precedence first):
+//  1. command line flags
+//  2. GOS3RVE_<FLAG> environment variables (GOS3RVE_KEY_VAL, GOS3RVE_DIR_BUCKETS, ...)
+//  3. configuration file (-config): XML, JSON, YAML or TOML by file extension
+//  4. flag defaults
+//
+// SIGHUP re-reads the configuration file. Credentials, users with their
+// policies, rate limits, maximal object size and TLS certificates are applied
+// at once, other changed settings only after restart (they are reported in
+// the log).
+
+const envPrefix = "GOS3RVE_"
+
+// activeConfig is the configuration file content the server runs with
+var activeConfig Config
+
+// applyEnvFlags sets flags not given on the command line from environment
+func applyEnvFlags() error {
+	var errs []error
+	flag.VisitAll(func(f *flag.Flag) {
+		if isFlagOn(f.Name) {
+			return
+		}
+		name := envPrefix + strings.ToUpper(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := flag.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s=\"%s\" : %w", name, value, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// isFlagOn reports whether flag was given on the command line or in environment
+func isFlagOn(name string) bool {
+	on := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			on = true
+		}
+	})
+	return on
+}
+
+// loadConfig reads configuration file in the format given by its extension
+// (XML unless .json, .yaml/.yml or .toml). Unknown settings are errors.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	log.Printf("Reading configuration from %s...\n", path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&cfg)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&cfg); err == io.EOF {
+			err = nil // empty file
+		}
+	case ".toml":
+		var md toml.MetaData
+		if md, err = toml.Decode(string(data), &cfg); err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown setting %s", undecoded[0])
+			}
+		}
+	default:
+		if err = xml.Unmarshal(data, &cfg); err == nil {
+			err = checkXMLElements(data)
+		}
+	}
+	return cfg, err
+}
+
+// checkXMLElements reports elements of XML config root Config has no field for
+func checkXMLElements(data []byte) error {
+	known := map[string]bool{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("xml"), ">")
+		known[name] = true
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && !known[token.Name.Local] {
+				return fmt.Errorf("unknown setting %s", token.Name.Local)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// validateSettings checks resolved settings, all problems are reported at once
+func validateSettings() error {
+	var errs []error
+
+	if !isValidDurability(durability) {
+		errs = append(errs, fmt.Errorf("invalid durability level \"%s\" (expected %s, %s or %s)", durability, durabilityNone, durabilityFile, durabilityFull))
+	}
+	if !isValidKeyEncoding(keyEncoding) {
+		errs = append(errs, fmt.Errorf("invalid key encoding \"%s\" (expected %s or %s)", keyEncoding, keyEncodingStrict, keyEncodingEncode))
+	}
+	if !isValidAccessLogFormat(accessLogFormat) {
+		errs = append(errs, fmt.Errorf("invalid access log format \"%s\" (expected %s or %s)", accessLogFormat, accessLogFormatS3, accessLogFormatJSON))
+	}
+
+	if svcPort <= 0 || svcPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %d", svcPort))
+	}
+	if tlsPort < 0 || tlsPort > 65535 || adminPort < 0 || adminPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid TLS port %d or admin port %d", tlsPort, adminPort))
+	}
+	if tlsPort != 0 && tlsPort == svcPort {
+		errs = append(errs, fmt.Errorf("TLS port %d is the same as port", tlsPort))
+	}
+	if adminPort != 0 && (adminPort == svcPort || adminPort == tlsPort) {
+		errs = append(errs, fmt.Errorf("admin port %d is taken by S3 listener", adminPort))
+	}
+
+	if (tlsCertPath == "") != (tlsKeyPath == "") {
+		errs = append(errs, fmt.Errorf("TLS needs both certificate and key file"))
+	}
+	if !tlsEnabled() && (tlsClientCAPath != "" || tlsPort != 0) {
+		errs = append(errs, fmt.Errorf("client CA and TLS port need TLS certificate and key file"))
+	}
+
+	if bucketPath == "" || uploadsPath == "" || metaPath == "" {
+		errs = append(errs, fmt.Errorf("buckets, uploads and metadata dirs must be set"))
+	}
+	if keyId == "" || secretKey == "" {
+		errs = append(errs, fmt.Errorf("access key id and secret access key must be set"))
+	}
+	if shutdownTimeout < 0 || readyMinFree < 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout and minimal free space can't be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// reloadableConfigFields are applied by reloadConfig, other fields need restart
+var reloadableConfigFields = map[string]bool{
+	"XMLName":         true,
+	"AccessKeyId":     true,
+	"SecretAccessKey": true,
+	"Users":           true,
+	"TLSCertFile":     true,
+	"TLSKeyFile":      true,
+	"TLSClientCAFile": true,
+	"RateLimit":       true,
+	"RateLimitKey":    true,
+	"RateLimitIP":     true,
+	"MaxObjectSize":   true,
+}
+
+// changedConfigFields lists settings which differ in the two configurations
+// and can't be applied without restart
+func changedConfigFields(old Config, cfg Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(cfg)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		if reloadableConfigFields[name] && (tlsEnabled() || !strings.HasPrefix(name, "TLS")) {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// configValue returns value of the configuration file unless the flag
+// overrides it (or it is not set in the file)
+func configValue(flagName string, current string, value string) string {
+	if value == "" || isFlagOn(flagName) {
+		return current
+	}
+	return value
+}
+
+// limitsConfig returns rate limits and maximal object size of configuration
+// file unless they are set by flags. Limits missing in the file are unlimited.
+func limitsConfig(cfg Config) (limitSettings, error) {
+	settings := flagLimitSettings()
+	if !isFlagOn("rate_limit") {
+		settings.rateLimit = cfg.RateLimit
+	}
+	if !isFlagOn("rate_limit_key") {
+		settings.rateLimitKey = cfg.RateLimitKey
+	}
+	if !isFlagOn("rate_limit_ip") {
+		settings.rateLimitIP = cfg.RateLimitIP
+	}
+	if !isFlagOn("max_object_size") {
+		settings.maxObjectSize = 0
+		if cfg.MaxObjectSize != "" {
+			return settings, settings.maxObjectSize.Set(cfg.MaxObjectSize)
+		}
+	}
+	return settings, nil
+}
+
+// reloadConfig re-reads configuration file (SIGHUP). Nothing is applied if
+// the new configuration is broken.
+func reloadConfig() {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil && !(os.IsNotExist(err) && !isFlagOn("config")) {
+		log.Printf("Error reloading configuration from %s (keeping the current one) : %s", cfgPath, err)
+		return
+	}
+
+	newKeyId := configValue("key_id", keyId, cfg.AccessKeyId)
+	newSecretKey := configValue("key_val", secretKey, cfg.SecretAccessKey)
+	ids, err := buildIdentities(cfg.Users, newKeyId, newSecretKey)
+	if err != nil {
+		log.Printf("Error reloading configuration from %s (keeping the current one) : %s", cfgPath, err)
+		return
+	}
+
+	settings, err := limitsConfig(cfg)
+	var limits *requestLimits
+	if err == nil {
+		limits, err = buildLimits(settings, cfg.Users)
+	}
+	if err != nil {
+		log.Printf("Error reloading limits from %s (keeping the current configuration) : %s", cfgPath, err)
+		return
+	}
+
+	if tlsEnabled() && activeTLS != nil {
+		err = activeTLS.reload(
+			configValue("tls_cert", tlsCertPath, cfg.TLSCertFile),
+			configValue("tls_key", tlsKeyPath, cfg.TLSKeyFile),
+			configValue("tls_client_ca", tlsClientCAPath, cfg.TLSClientCAFile))
+		if err != nil {
+			log.Printf("Error reloading TLS certificates (keeping the current configuration) : %s", err)
+			return
+		}
+	}
+
+	setIdentities(ids)
+	keyId, secretKey = newKeyId, newSecretKey
+	settings.apply()
+	activeLimits.Store(limits)
+
+	for _, name := range changedConfigFields(activeConfig, cfg) {
+		log.Printf("*** Note: %s changed in %s, restart needed to apply it", name, cfgPath)
+	}
+	activeConfig = cfg
+
+	log.Printf("Configuration reloaded from %s (%d access keys)", cfgPath, len(ids))
+}
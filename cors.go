@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Bucket CORS configuration
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/cors.html
+
+const maxCORSRules = 100
+
+var corsMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPut:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodDelete: true,
+}
+
+type XmlCORSRule struct {
+	ID             string   `xml:"ID,omitempty"`
+	AllowedHeaders []string `xml:"AllowedHeader"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	ExposeHeaders  []string `xml:"ExposeHeader"`
+	MaxAgeSeconds  *int     `xml:"MaxAgeSeconds"`
+}
+
+type XmlCORSConfiguration struct {
+	XMLName xml.Name      `xml:"CORSConfiguration" json:"-"`
+	Xmlns   string        `xml:"xmlns,attr,omitempty" json:"-"`
+	Rules   []XmlCORSRule `xml:"CORSRule"`
+}
+
+// validate checks configuration against S3 rules: origins and allowed headers
+// may contain at most one "*" wildcard, methods are limited to corsMethods
+func (c *XmlCORSConfiguration) validate() ErrorCode {
+	if len(c.Rules) == 0 || len(c.Rules) > maxCORSRules {
+		return ErrMalformedXML
+	}
+
+	for _, rule := range c.Rules {
+		if len(rule.AllowedMethods) == 0 || len(rule.AllowedOrigins) == 0 {
+			return ErrMalformedXML
+		}
+		for _, method := range rule.AllowedMethods {
+			if !corsMethods[method] {
+				return ErrInvalidRequest
+			}
+		}
+		for _, value := range append(append([]string{}, rule.AllowedOrigins...), rule.AllowedHeaders...) {
+			if strings.Count(value, "*") > 1 {
+				return ErrInvalidRequest
+			}
+		}
+		if rule.MaxAgeSeconds != nil && *rule.MaxAgeSeconds < 0 {
+			return ErrMalformedXML
+		}
+	}
+
+	return ErrNone
+}
+
+// corsMatch compares value with pattern containing at most one "*"
+func corsMatch(pattern string, value string, ignoreCase bool) bool {
+	if ignoreCase {
+		pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	}
+
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == value
+	}
+	return len(value) >= len(prefix)+len(suffix) && strings.HasPrefix(value, prefix) && strings.HasSuffix(value, suffix)
+}
+
+func corsMatchAny(patterns []string, value string, ignoreCase bool) bool {
+	for _, pattern := range patterns {
+		if corsMatch(pattern, value, ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRule returns the first rule allowing request from origin using method
+// with given headers (nil if there is none)
+func (c *XmlCORSConfiguration) matchRule(origin string, method string, headers []string) *XmlCORSRule {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if !corsMatchAny(rule.AllowedOrigins, origin, false) || !corsMatchAny(rule.AllowedMethods, method, false) {
+			continue
+		}
+
+		allowed := true
+		for _, header := range headers {
+			if !corsMatchAny(rule.AllowedHeaders, header, true) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return rule
+		}
+	}
+	return nil
+}
+
+// setCORSResponseHeaders fills in Access-Control-* headers for origin allowed by rule
+func setCORSResponseHeaders(w http.ResponseWriter, rule *XmlCORSRule, origin string) {
+	h := w.Header()
+	if contains(rule.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ", "))
+	if len(rule.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+	}
+	if rule.MaxAgeSeconds != nil {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(*rule.MaxAgeSeconds))
+	}
+}
+
+// setCORSHeaders adds Access-Control-* headers to responses of cross-origin
+// requests allowed by the bucket configuration
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	bucketName, _, _ := extractBucketAndKey(r)
+	if !isSafeBucketName(bucketName) {
+		return
+	}
+
+	config := loadBucketMeta(bucketName).CORS
+	if config == nil {
+		return
+	}
+
+	w.Header().Set("Vary", "Origin, Access-Control-Request-Headers, Access-Control-Request-Method")
+	if rule := config.matchRule(origin, r.Method, nil); rule != nil {
+		setCORSResponseHeaders(w, rule, origin)
+	}
+}
+
+// handleOptionsRequest answers CORS preflight requests. Browsers do not sign
+// them, so they are served before authentication.
+func handleOptionsRequest(w http.ResponseWriter, r *http.Request) {
+	bucketName, _, _ := extractBucketAndKey(r)
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" {
+		s3err(w, ErrInvalidRequest)
+		return
+	}
+
+	if !isSafeBucketName(bucketName) {
+		s3err(w, ErrInvalidBucketName)
+		return
+	}
+
+	if _, err := os.Stat(bucketDir(bucketName)); os.IsNotExist(err) {
+		s3err(w, ErrNoSuchBucket)
+		return
+	}
+
+	var headers []string
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+
+	w.Header().Set("Vary", "Origin, Access-Control-Request-Headers, Access-Control-Request-Method")
+
+	config := loadBucketMeta(bucketName).CORS
+	if config == nil {
+		s3err(w, ErrCORSForbidden)
+		return
+	}
+
+	rule := config.matchRule(origin, method, headers)
+	if rule == nil {
+		s3err(w, ErrCORSForbidden)
+		return
+	}
+
+	setCORSResponseHeaders(w, rule, origin)
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketCors.html
+func putBucketCors(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var config XmlCORSConfiguration
+	if err = xml.Unmarshal(body, &config); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	if code := config.validate(); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	err = updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.CORS = &config
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving CORS configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketCors.html
+func getBucketCors(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	config := loadBucketMeta(bucketName).CORS
+	if config == nil {
+		s3err(w, ErrNoSuchCORSConfiguration)
+		return nil
+	}
+
+	config.Xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+	return writeXML(w, config)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketCors.html
+func deleteBucketCors(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	err := updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.CORS = nil
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error removing CORS configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
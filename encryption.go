@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Server-side encryption at rest (SSE-S3 style)
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/UsingServerSideEncryption.html
+//
+// Every encrypted object has its own random data key, which is kept in the
+// object's metadata wrapped (AES-256-GCM) with the current master key from
+// -sse_master_key file. Data file starts with a header (magic and random salt)
+// followed by chunks of up to sseChunkSize bytes of plaintext sealed with
+// AES-256-GCM under a key derived from the data key and the salt. Chunks are
+// numbered by their nonce and the last one is marked, so chunks can be read
+// (and ranges served) independently while reordering or truncation is detected.
+
+const (
+	sseAlgorithmAES256 = "AES256"
+
+	sseChunkSize  = 64 * 1024
+	sseTagSize    = 16
+	sseSaltSize   = 32
+	sseHeaderSize = 8 + sseSaltSize
+)
+
+var sseMagic = []byte("GOS3SSE1")
+
+var (
+	sseMasterKeyPath string // "" disables server-side encryption
+	sseRotateKey     bool
+)
+
+// ObjectEncryption describes how object (or parts of multipart upload) are
+// encrypted
+type ObjectEncryption struct {
+	Algorithm string `json:"algorithm"`
+	KeyId     string `json:"keyId,omitempty"`   // master key which wraps DataKey
+	DataKey   string `json:"dataKey,omitempty"` // base64 of wrapped data key
+	Size      int64  `json:"size"`              // size of plaintext
+
+	// SSE-C objects (see ssec.go)
+	CustomerKeyMD5  string `json:"customerKeyMD5,omitempty"`
+	CustomerKeySalt string `json:"customerKeySalt,omitempty"`
+	CustomerKeyHash string `json:"customerKeyHash,omitempty"`
+	customerKey     []byte // checked key of the current request
+}
+
+// sseMasterKey is an entry of the master key file: "<id> <base64 key>" per
+// line, the last one is used to wrap new data keys
+type sseMasterKey struct {
+	id  string
+	key []byte
+}
+
+var sseMasterKeys []sseMasterKey
+
+func sseEnabled() bool {
+	return len(sseMasterKeys) > 0
+}
+
+func currentMasterKey() sseMasterKey {
+	return sseMasterKeys[len(sseMasterKeys)-1]
+}
+
+// loadMasterKeys reads master key file, a new one with a single key is
+// created if it does not exist
+func loadMasterKeys(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("Creating master key file %s", path)
+		if err = appendMasterKey(path); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var keys []sseMasterKey
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected \"<id> <base64 key>\"", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("line %d: key must be 32 bytes in base64", line)
+		}
+		keys = append(keys, sseMasterKey{id: fields[0], key: key})
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+
+	sseMasterKeys = keys
+	return nil
+}
+
+// appendMasterKey adds a new random key to the master key file making it
+// the current one
+func appendMasterKey(path string) error {
+	key := make([]byte, 32)
+	id := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%s %s\n", hex.EncodeToString(id), base64.StdEncoding.EncodeToString(key))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapDataKey(dataKey []byte) (string, string, error) {
+	master := currentMasterKey()
+	aead, err := newGCM(master.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(master.id))
+	return master.id, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unwrapDataKey(keyId string, wrapped string) ([]byte, error) {
+	var master *sseMasterKey
+	for i := range sseMasterKeys {
+		if sseMasterKeys[i].id == keyId {
+			master = &sseMasterKeys[i]
+		}
+	}
+	if master == nil {
+		return nil, fmt.Errorf("unknown master key %s", keyId)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(master.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(master.id))
+}
+
+// newObjectEncryption generates data key for a new object
+func newObjectEncryption() (*ObjectEncryption, []byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	keyId, wrapped, err := wrapDataKey(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ObjectEncryption{Algorithm: sseAlgorithmAES256, KeyId: keyId, DataKey: wrapped}, dataKey, nil
+}
+
+// dataKey returns unwrapped data key (customer key of SSE-C objects, once
+// checked by checkSSECustomerKey)
+func (e *ObjectEncryption) dataKey() ([]byte, error) {
+	if e.isCustomerKey() {
+		if e.customerKey == nil {
+			return nil, errors.New("customer key not provided")
+		}
+		return e.customerKey, nil
+	}
+	return unwrapDataKey(e.KeyId, e.DataKey)
+}
+
+// renew returns encryption of the same kind with a new data key (SSE-C
+// objects keep using the customer key)
+func (e *ObjectEncryption) renew() (*ObjectEncryption, []byte, error) {
+	if e.isCustomerKey() {
+		renewed := *e
+		renewed.Size = 0
+		dataKey, err := renewed.dataKey()
+		return &renewed, dataKey, err
+	}
+	return newObjectEncryption()
+}
+
+// parseSSERequest returns encryption requested by SSE-C headers,
+// x-amz-server-side-encryption header or bucket default (nil if object is
+// stored in plain)
+func parseSSERequest(r *http.Request, bucketName string) (*ObjectEncryption, []byte, ErrorCode) {
+	customerKey, code := parseSSECustomerKey(r, ssecHeaderPrefix)
+	if code != ErrNone {
+		return nil, nil, code
+	}
+	if customerKey != nil {
+		if r.Header.Get("x-amz-server-side-encryption") != "" {
+			return nil, nil, ErrInvalidArgument
+		}
+		enc, err := newCustomerEncryption(customerKey)
+		if err != nil {
+			log.Printf("Error generating customer key salt : %s", err)
+			return nil, nil, ErrInternalError
+		}
+		return enc, customerKey, ErrNone
+	}
+
+	algorithm := r.Header.Get("x-amz-server-side-encryption")
+	if algorithm == "" {
+		if config := loadBucketMeta(bucketName).Encryption; config != nil {
+			algorithm = config.Rule.Default.SSEAlgorithm
+		}
+	}
+
+	switch algorithm {
+	case "":
+		return nil, nil, ErrNone
+	case sseAlgorithmAES256:
+	case "aws:kms", "aws:kms:dsse":
+		return nil, nil, ErrNotImplemented
+	default:
+		return nil, nil, ErrInvalidArgument
+	}
+
+	if !sseEnabled() {
+		log.Printf("Server-side encryption requested for bucket %s, but no -sse_master_key is configured", bucketName)
+		return nil, nil, ErrNotImplemented
+	}
+
+	enc, dataKey, err := newObjectEncryption()
+	if err != nil {
+		log.Printf("Error generating data key : %s", err)
+		return nil, nil, ErrInternalError
+	}
+	return enc, dataKey, ErrNone
+}
+
+// setSSEHeaders adds x-amz-server-side-encryption (or SSE-C) headers for
+// encrypted objects
+func setSSEHeaders(w http.ResponseWriter, enc *ObjectEncryption) {
+	switch {
+	case enc.isCustomerKey():
+		w.Header().Set(ssecHeaderPrefix+"algorithm", enc.Algorithm)
+		w.Header().Set(ssecHeaderPrefix+"key-MD5", enc.CustomerKeyMD5)
+	case enc != nil && enc.Algorithm == sseAlgorithmAES256:
+		w.Header().Set("x-amz-server-side-encryption", sseAlgorithmAES256)
+	}
+}
+
+// streamCipher derives AEAD of a data file from data key and file's salt
+func streamCipher(dataKey []byte, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write(salt)
+	return newGCM(mac.Sum(nil))
+}
+
+func chunkNonce(nonce []byte, index int64) []byte {
+	for i := range nonce[:4] {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptedSize returns size of data file holding size bytes of plaintext
+func encryptedSize(size int64) int64 {
+	chunks := (size + sseChunkSize - 1) / sseChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return sseHeaderSize + size + chunks*sseTagSize
+}
+
+// plainSize is the inverse of encryptedSize
+func plainSize(fileSize int64) (int64, error) {
+	body := fileSize - sseHeaderSize
+	full, rest := body/(sseChunkSize+sseTagSize), body%(sseChunkSize+sseTagSize)
+	if body < sseTagSize || (rest > 0 && rest < sseTagSize) {
+		return 0, errors.New("truncated encrypted file")
+	}
+	if rest == 0 {
+		return full * sseChunkSize, nil
+	}
+	return full*sseChunkSize + rest - sseTagSize, nil
+}
+
+// sseWriter encrypts data written into it, Close seals the last chunk
+// (it does not close the underlying writer)
+type sseWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	out   []byte
+	nonce []byte
+	index int64
+}
+
+func newSSEWriter(w io.Writer, dataKey []byte) (*sseWriter, error) {
+	salt := make([]byte, sseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := streamCipher(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(append(append([]byte{}, sseMagic...), salt...)); err != nil {
+		return nil, err
+	}
+
+	return &sseWriter{
+		w:     w,
+		aead:  aead,
+		buf:   make([]byte, 0, sseChunkSize),
+		out:   make([]byte, 0, sseChunkSize+sseTagSize),
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (s *sseWriter) seal(final bool) error {
+	s.out = s.aead.Seal(s.out[:0], chunkNonce(s.nonce, s.index), s.buf, chunkAAD(final))
+	s.buf = s.buf[:0]
+	s.index++
+	_, err := s.w.Write(s.out)
+	return err
+}
+
+func (s *sseWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// full chunk is sealed only once more data arrives, the last chunk
+		// is sealed by Close
+		if len(s.buf) == sseChunkSize {
+			if err := s.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):sseChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (s *sseWriter) Close() error {
+	return s.seal(true)
+}
+
+// sseReader decrypts data file, reads at arbitrary offsets only open the
+// chunks they cover
+type sseReader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+
+	nonce  []byte
+	sealed []byte
+	index  int64 // chunk held in plain (-1 if none)
+	plain  []byte
+}
+
+func newSSEReader(r io.ReaderAt, dataKey []byte, size int64) (*sseReader, error) {
+	header := make([]byte, sseHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(sseMagic)], sseMagic) {
+		return nil, errors.New("not an encrypted file")
+	}
+
+	aead, err := streamCipher(dataKey, header[len(sseMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := (size + sseChunkSize - 1) / sseChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	return &sseReader{
+		r:      r,
+		aead:   aead,
+		size:   size,
+		chunks: chunks,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, sseChunkSize+sseTagSize),
+		index:  -1,
+	}, nil
+}
+
+func (s *sseReader) chunk(index int64) ([]byte, error) {
+	if index == s.index {
+		return s.plain, nil
+	}
+
+	length := s.size - index*sseChunkSize
+	if length > sseChunkSize {
+		length = sseChunkSize
+	}
+
+	sealed := s.sealed[:length+sseTagSize]
+	if _, err := s.r.ReadAt(sealed, sseHeaderSize+index*(sseChunkSize+sseTagSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	plain, err := s.aead.Open(s.plain[:0], chunkNonce(s.nonce, index), sealed, chunkAAD(index == s.chunks-1))
+	if err != nil {
+		s.index = -1
+		return nil, fmt.Errorf("chunk %d: %w", index, err)
+	}
+
+	s.index, s.plain = index, plain
+	return plain, nil
+}
+
+func (s *sseReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < s.size {
+		index := off / sseChunkSize
+		plain, err := s.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		k := copy(p[n:], plain[off-index*sseChunkSize:])
+		n += k
+		off += int64(k)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// encryption returns encryption of the object (nil for plain objects and
+// objects without metadata)
+func (m *ObjectMeta) encryption() *ObjectEncryption {
+	if m == nil {
+		return nil
+	}
+	return m.Encryption
+}
+
+// objectReader returns reader of object's plaintext along with its size
+func objectReader(file *os.File, fstat os.FileInfo, meta *ObjectMeta) (io.ReaderAt, int64, error) {
+	if meta == nil || meta.Encryption == nil {
+		return file, fstat.Size(), nil
+	}
+
+	dataKey, err := meta.Encryption.dataKey()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader, err := newSSEReader(file, dataKey, meta.Encryption.Size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return reader, meta.Encryption.Size, nil
+}
+
+// isEncryptedFile reports whether the data file starts with the header of
+// encrypted files. Such files without metadata can't be served.
+func isEncryptedFile(file io.ReaderAt) bool {
+	magic := make([]byte, len(sseMagic))
+	_, err := file.ReadAt(magic, 0)
+	return err == nil && bytes.Equal(magic, sseMagic)
+}
+
+// objectSize returns size of the object (plaintext) stored in file described by info
+func objectSize(bucketName string, objectKey string, info fs.FileInfo) int64 {
+	if meta := loadObjectMeta(bucketName, objectKey, info); meta != nil && meta.Encryption != nil {
+		return meta.Encryption.Size
+	}
+	return info.Size()
+}
+
+// readPartFile returns plaintext of a part of multipart upload
+func readPartFile(path string, enc *ObjectEncryption) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || enc == nil {
+		return data, err
+	}
+
+	size, err := plainSize(int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := enc.dataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newSSEReader(bytes.NewReader(data), dataKey, size)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, size)
+	if _, err = reader.ReadAt(plain, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// rotateMasterKey adds a new master key and re-wraps data keys of all
+// objects and multipart uploads with it. It is meant to be run while the
+// server is stopped; old keys can be removed from the file afterwards.
+func rotateMasterKey(path string) error {
+	if err := appendMasterKey(path); err != nil {
+		return err
+	}
+	if err := loadMasterKeys(path); err != nil {
+		return err
+	}
+
+	current := currentMasterKey().id
+	rewrapped := 0
+
+	rewrap := func(enc *ObjectEncryption) (bool, error) {
+		if enc == nil || enc.isCustomerKey() || enc.KeyId == current {
+			return false, nil
+		}
+		dataKey, err := enc.dataKey()
+		if err != nil {
+			return false, err
+		}
+		enc.KeyId, enc.DataKey, err = wrapDataKey(dataKey)
+		return err == nil, err
+	}
+
+	// records are rewritten in place, size/mtime of data files stay the same
+	update := func(path string, record interface{}, encs func() []*ObjectEncryption) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, record); err != nil {
+			log.Printf("Skipping unreadable record %s : %s", path, err)
+			return nil
+		}
+		changed := false
+		for _, enc := range encs() {
+			ok, err := rewrap(enc)
+			if err != nil {
+				return err
+			}
+			changed = changed || ok
+		}
+		if !changed {
+			return nil
+		}
+		if data, err = json.Marshal(record); err != nil {
+			return err
+		}
+		rewrapped++
+		return writeFileAtomic(path, data)
+	}
+
+	err := filepath.WalkDir(metaPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(filepath.Dir(filepath.Dir(path))) != "objects" || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		var meta ObjectMeta
+		return update(path, &meta, func() []*ObjectEncryption {
+			return []*ObjectEncryption{meta.Encryption, meta.Previous.encryption()}
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(uploadsPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		var upload MultipartUpload
+		return update(path, &upload, func() []*ObjectEncryption { return []*ObjectEncryption{upload.Encryption} })
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Master key rotated to %s, %d data keys re-wrapped", current, rewrapped)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ServerSideEncryptionConfiguration.html
+type XmlSSEByDefault struct {
+	SSEAlgorithm   string `xml:"SSEAlgorithm"`
+	KMSMasterKeyID string `xml:"KMSMasterKeyID,omitempty"`
+}
+
+type XmlSSERule struct {
+	Default          XmlSSEByDefault `xml:"ApplyServerSideEncryptionByDefault"`
+	BucketKeyEnabled bool            `xml:"BucketKeyEnabled"`
+}
+
+type XmlSSEConfiguration struct {
+	XMLName xml.Name   `xml:"ServerSideEncryptionConfiguration" json:"-"`
+	Xmlns   string     `xml:"xmlns,attr,omitempty" json:"-"`
+	Rule    XmlSSERule `xml:"Rule"`
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketEncryption.html
+func putBucketEncryption(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var config XmlSSEConfiguration
+	if err = xml.Unmarshal(body, &config); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	switch config.Rule.Default.SSEAlgorithm {
+	case sseAlgorithmAES256:
+	case "aws:kms", "aws:kms:dsse":
+		s3err(w, ErrNotImplemented)
+		return nil
+	default:
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	if !sseEnabled() {
+		log.Printf("PutBucketEncryption %s: no -sse_master_key is configured", bucketName)
+		s3err(w, ErrNotImplemented)
+		return nil
+	}
+
+	err = updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Encryption = &config
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving encryption configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketEncryption.html
+func getBucketEncryption(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	config := loadBucketMeta(bucketName).Encryption
+	if config == nil {
+		s3err(w, ErrNoSuchEncryptionConfiguration)
+		return nil
+	}
+
+	config.Xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+	return writeXML(w, config)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketEncryption.html
+func deleteBucketEncryption(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	err := updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Encryption = nil
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error removing encryption configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
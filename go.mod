@@ -2,8 +2,8 @@ module shvechkov.com/gos3rve
 
 go 1.22
 
-
-require github.com/google/uuid v1.6.0
-
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/google/uuid v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// forceDeleteHeader asks DeleteBucket to remove a non-empty bucket (admins only)
+const forceDeleteHeader = "x-gos3rve-force-delete"
+
+// s3Identity is a set of credentials requests can be signed with. The
+// key_id/key_val pair given on the command line (or in config root) is always
+// an admin, additional users come from <Users> in the config file.
+type s3Identity struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Admin           bool
+	Policy          *PolicyDocument
+}
+
+// ConfigUser is the <User> element of the config file
+type ConfigUser struct {
+	AccessKeyId     string `xml:"AccessKeyId" json:"AccessKeyId" yaml:"AccessKeyId" toml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey" json:"SecretAccessKey" yaml:"SecretAccessKey" toml:"SecretAccessKey"`
+	Admin           bool   `xml:"Admin" json:"Admin" yaml:"Admin" toml:"Admin"`
+	PolicyFile      string `xml:"PolicyFile" json:"PolicyFile" yaml:"PolicyFile" toml:"PolicyFile"`
+	RateLimit       string `xml:"RateLimit" json:"RateLimit" yaml:"RateLimit" toml:"RateLimit"`
+}
+
+// identities by access key id (replaced as a whole on config reload)
+var (
+	identitiesMu sync.RWMutex
+	identities   = map[string]*s3Identity{}
+)
+
+// buildIdentities creates identities of config users and of the primary key
+// (which is always an admin), loading their policy files
+func buildIdentities(users []ConfigUser, accessKeyId string, secretAccessKey string) (map[string]*s3Identity, error) {
+	ids := map[string]*s3Identity{}
+	for _, user := range users {
+		if user.AccessKeyId == "" || user.SecretAccessKey == "" {
+			return nil, fmt.Errorf("user entries need both AccessKeyId and SecretAccessKey")
+		}
+		if _, ok := ids[user.AccessKeyId]; ok || user.AccessKeyId == accessKeyId {
+			return nil, fmt.Errorf("access key id %s is used more than once", user.AccessKeyId)
+		}
+
+		id := &s3Identity{AccessKeyId: user.AccessKeyId, SecretAccessKey: user.SecretAccessKey, Admin: user.Admin}
+		if user.PolicyFile != "" {
+			policy, err := loadPolicyFile(user.PolicyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading policy of user %s from %s : %w", user.AccessKeyId, user.PolicyFile, err)
+			}
+			id.Policy = policy
+		}
+		ids[user.AccessKeyId] = id
+	}
+	ids[accessKeyId] = &s3Identity{AccessKeyId: accessKeyId, SecretAccessKey: secretAccessKey, Admin: true}
+	return ids, nil
+}
+
+func setIdentities(ids map[string]*s3Identity) {
+	identitiesMu.Lock()
+	identities = ids
+	identitiesMu.Unlock()
+}
+
+func lookupIdentity(accessKeyId string) *s3Identity {
+	identitiesMu.RLock()
+	defer identitiesMu.RUnlock()
+	return identities[accessKeyId]
+}
+
+// allIdentities returns identities sorted by access key id
+func allIdentities() []*s3Identity {
+	identitiesMu.RLock()
+	ids := make([]*s3Identity, 0, len(identities))
+	for _, id := range identities {
+		ids = append(ids, id)
+	}
+	identitiesMu.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i].AccessKeyId < ids[j].AccessKeyId })
+	return ids
+}
+
+type identityCtxKey struct{}
+
+// withIdentity attaches authenticated identity to the request
+func withIdentity(r *http.Request, id *s3Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityCtxKey{}, id))
+}
+
+// requestIdentity returns identity the request was signed with (nil if none)
+func requestIdentity(r *http.Request) *s3Identity {
+	id, _ := r.Context().Value(identityCtxKey{}).(*s3Identity)
+	return id
+}
+
+func isAdminRequest(r *http.Request) bool {
+	id := requestIdentity(r)
+	return id != nil && id.Admin
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Key encoding modes (-key_encoding flag). S3 allows keys a POSIX filesystem
+// can't store directly: "a/b" next to "a/b/c", trailing slashes, "//", "."/".."
+// segments, names over 255 bytes. In strict mode such keys are rejected, in
+// encode mode they are mapped onto reserved on-disk names (plain keys stay
+// human readable) and decoded back in listings.
+const (
+	keyEncodingStrict = "strict"
+	keyEncodingEncode = "encode"
+)
+
+// All on-disk names starting with reservedPrefix belong to the server
+// (see also tmpFilePrefix).
+const (
+	reservedPrefix  = ".gos3rve-"
+	selfObjectName  = ".gos3rve-obj"   // object "a/b" stored inside directory "a/b" (because "a/b/c" exists)
+	slashObjectName = ".gos3rve-slash" // object "a/b/" (key with trailing slash) stored inside directory "a/b"
+	escapedPrefix   = ".gos3rve-b64-"  // segment stored as base64url (".", "..", "", reserved names)
+	hashedPrefix    = ".gos3rve-sha-"  // segment too long for the filesystem, original is in the names store
+)
+
+var keyEncoding string
+
+func isValidKeyEncoding(mode string) bool {
+	return mode == keyEncodingStrict || mode == keyEncodingEncode
+}
+
+// segmentNeedsEncoding reports whether key segment can't be used as file name as is
+func segmentNeedsEncoding(segment string) bool {
+	return segment == "" || segment == "." || segment == ".." ||
+		strings.HasPrefix(segment, reservedPrefix) || len(segment) > maxPathComponent
+}
+
+// segmentNamePath returns location of the record keeping original name of a hashed segment
+func segmentNamePath(bucketName string, hashed string) string {
+	return filepath.Join(metaPath, bucketName, "names", strings.TrimPrefix(hashed, hashedPrefix))
+}
+
+// encodeSegment maps key segment onto on-disk name
+func encodeSegment(bucketName string, segment string) string {
+	if !segmentNeedsEncoding(segment) {
+		return segment
+	}
+
+	escaped := escapedPrefix + base64.RawURLEncoding.EncodeToString([]byte(segment))
+	if len(escaped) <= maxPathComponent {
+		return escaped
+	}
+
+	sum := sha256.Sum256([]byte(segment))
+	hashed := hashedPrefix + hex.EncodeToString(sum[:])
+
+	namePath := segmentNamePath(bucketName, hashed)
+	if _, err := os.Stat(namePath); os.IsNotExist(err) {
+		if err = writeFileAtomic(namePath, []byte(segment)); err != nil {
+			log.Printf("Error saving name of %s/%s : %s\n", bucketName, hashed, err)
+		}
+	}
+
+	return hashed
+}
+
+// decodeSegment maps on-disk name back onto key segment. ok is false for
+// names which do not correspond to a segment (temp files, self/slash objects).
+func decodeSegment(bucketName string, name string) (segment string, ok bool) {
+	if !strings.HasPrefix(name, reservedPrefix) {
+		return name, true
+	}
+
+	if strings.HasPrefix(name, escapedPrefix) {
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(name, escapedPrefix))
+		if err != nil {
+			return "", false
+		}
+		return string(data), true
+	}
+
+	if strings.HasPrefix(name, hashedPrefix) {
+		data, err := os.ReadFile(segmentNamePath(bucketName, name))
+		if err != nil {
+			log.Printf("Unknown hashed name %s in bucket %s\n", name, bucketName)
+			return "", false
+		}
+		return string(data), true
+	}
+
+	return "", false
+}
+
+// objectFilePath returns file holding the object stored at path - for a
+// directory that is its self object (if there is one)
+func objectFilePath(path string) string {
+	if fstat, err := os.Stat(path); err == nil && fstat.IsDir() {
+		self := filepath.Join(path, selfObjectName)
+		if _, err := os.Stat(self); err == nil {
+			return self
+		}
+	}
+	return path
+}
+
+// isDirKey reports whether objectKey is stored as a directory: in strict mode
+// key "a/" is directory "a" and never names the file of object "a"
+func isDirKey(objectKey string) bool {
+	return strings.HasSuffix(objectKey, "/") && keyEncoding != keyEncodingEncode
+}
+
+// objectWritePath returns where the object stored at path has to be written.
+// Must be called under the key lock.
+func objectWritePath(path string) (string, ErrorCode) {
+	if fstat, err := os.Stat(path); err == nil && fstat.IsDir() {
+		if keyEncoding != keyEncodingEncode {
+			return "", ErrExistingObjectIsDirectory
+		}
+		return filepath.Join(path, selfObjectName), ErrNone
+	}
+	return path, ErrNone
+}
+
+// prepareObjectDirs creates directories leading to path. In encode mode objects
+// standing in the way (key "a/b" when writing "a/b/c") are moved into the
+// directories replacing them.
+func prepareObjectDirs(bucketName string, path string) ErrorCode {
+	root := bucketDir(bucketName)
+
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil || !isWithinDir(root, filepath.Dir(path)) {
+		return ErrInvalidObjectName
+	}
+	if rel == "." {
+		return ErrNone
+	}
+
+	dir, key := root, ""
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		segment, _ := decodeSegment(bucketName, name)
+		if key != "" {
+			key += "/"
+		}
+		key += segment
+
+		for attempt := 0; ; attempt++ {
+			fstat, err := os.Lstat(dir)
+			if err == nil && fstat.IsDir() {
+				break
+			}
+
+			if attempt > 2 {
+				log.Printf("Could not create directory %s\n", dir)
+				return ErrInternalError
+			}
+
+			if os.IsNotExist(err) {
+				if err = os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+					log.Printf("Error creating directory %s : %s\n", dir, err)
+					return ErrInternalError
+				}
+				continue
+			}
+
+			if err != nil {
+				log.Printf("Error checking %s : %s\n", dir, err)
+				return ErrInternalError
+			}
+
+			if keyEncoding != keyEncodingEncode {
+				return ErrExistingObjectIsFile
+			}
+
+			if code := moveObjectIntoDir(bucketName, key, dir); code != ErrNone {
+				return code
+			}
+		}
+	}
+
+	return ErrNone
+}
+
+// moveObjectIntoDir turns object file at path into directory holding the
+// object as its self object
+func moveObjectIntoDir(bucketName string, objectKey string, path string) ErrorCode {
+	unlock := objectLocks.Lock(bucketName, objectKey)
+	defer unlock()
+
+	// somebody else might have done it already
+	if fstat, err := os.Lstat(path); err != nil || fstat.IsDir() {
+		return ErrNone
+	}
+
+	tmp, err := createTempFile(path)
+	if err != nil {
+		log.Printf("Error creating temp file for %s : %s\n", path, err)
+		return ErrInternalError
+	}
+	tmp.Close()
+
+	if err = os.Rename(path, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error moving %s : %s\n", path, err)
+		return ErrInternalError
+	}
+
+	if err = os.Mkdir(path, 0755); err != nil {
+		os.Rename(tmp.Name(), path)
+		log.Printf("Error creating directory %s : %s\n", path, err)
+		return ErrInternalError
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(path, selfObjectName)); err != nil {
+		log.Printf("Error moving %s into %s : %s\n", tmp.Name(), path, err)
+		return ErrInternalError
+	}
+
+	return ErrNone
+}
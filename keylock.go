@@ -0,0 +1,71 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// keyLocker serialises mutations of objects. Locks are striped - bucket/key is
+// hashed onto a fixed set of RW mutexes, so memory use does not depend on the
+// number of keys. Unrelated keys may share a stripe, which only costs some
+// concurrency.
+//
+// Writers stream data into temp files without holding a lock and take the
+// write lock only to commit (rename + metadata), so the last writer to commit
+// wins. Readers take the read lock while they open the file and load its
+// metadata; afterwards they read from the open descriptor which keeps pointing
+// at a complete version even if the object gets replaced or deleted.
+//
+// Writers also share the lock of their bucket, which LockBucket takes
+// exclusively to stop all writes to the bucket. Lock must not be nested.
+type keyLocker struct {
+	stripes []sync.RWMutex
+	buckets []sync.RWMutex
+}
+
+var objectLocks = newKeyLocker(1024)
+
+func newKeyLocker(stripes int) *keyLocker {
+	return &keyLocker{stripes: make([]sync.RWMutex, stripes), buckets: make([]sync.RWMutex, stripes)}
+}
+
+func (l *keyLocker) bucketStripe(bucketName string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName))
+	return &l.buckets[h.Sum32()%uint32(len(l.buckets))]
+}
+
+func (l *keyLocker) stripe(bucketName string, objectKey string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName))
+	h.Write([]byte{'/'})
+	h.Write([]byte(objectKey))
+	return &l.stripes[h.Sum32()%uint32(len(l.stripes))]
+}
+
+// Lock takes exclusive lock on bucket/key and returns function releasing it
+func (l *keyLocker) Lock(bucketName string, objectKey string) func() {
+	b := l.bucketStripe(bucketName)
+	b.RLock()
+	m := l.stripe(bucketName, objectKey)
+	m.Lock()
+	return func() {
+		m.Unlock()
+		b.RUnlock()
+	}
+}
+
+// LockBucket waits for writers of the bucket to finish and blocks new ones
+// until the returned function is called
+func (l *keyLocker) LockBucket(bucketName string) func() {
+	b := l.bucketStripe(bucketName)
+	b.Lock()
+	return b.Unlock
+}
+
+// RLock takes shared lock on bucket/key and returns function releasing it
+func (l *keyLocker) RLock(bucketName string, objectKey string) func() {
+	m := l.stripe(bucketName, objectKey)
+	m.RLock()
+	return m.RUnlock
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// acquired reports whether lock returns within a short time
+func acquired(lock func() func()) (bool, func()) {
+	done := make(chan func(), 1)
+	go func() { done <- lock() }()
+	select {
+	case unlock := <-done:
+		return true, unlock
+	case <-time.After(100 * time.Millisecond):
+		return false, func() { (<-done)() }
+	}
+}
+
+func TestLockBucket(t *testing.T) {
+	locks := newKeyLocker(16)
+
+	unlockKey := locks.Lock("bkt", "a")
+	ok, unlockBucket := acquired(func() func() { return locks.LockBucket("bkt") })
+	if ok {
+		t.Fatal("LockBucket doesn't wait for writers of the bucket")
+	}
+	unlockKey()
+
+	ok, unlockKey = acquired(func() func() { return locks.Lock("bkt", "b") })
+	if ok {
+		t.Fatal("Lock doesn't wait for LockBucket")
+	}
+	if ok, unlockRead := acquired(func() func() { return locks.RLock("bkt", "c") }); !ok {
+		t.Fatal("readers are blocked by LockBucket")
+	} else {
+		unlockRead()
+	}
+
+	unlockBucket()
+	unlockKey()
+}
+
+// testStorage points data dirs to a temp dir and creates bucket bkt
+func testStorage(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	bucketPath, uploadsPath, metaPath = dir+"/buckets", dir+"/uploads", dir+"/meta"
+	durability, keyEncoding = durabilityNone, keyEncodingStrict
+	limits, _ := buildLimits(limitSettings{}, nil)
+	activeLimits.Store(limits)
+	for _, path := range []string{bucketDir("bkt"), uploadsPath, metaPath} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testRequest(method string, target string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	switch method {
+	case http.MethodPut:
+		handlePutRequest(w, r)
+	case http.MethodGet:
+		handleGetRequest(w, r)
+	case http.MethodDelete:
+		handleDeleteRequest(w, r)
+	}
+	return w
+}
+
+// Writers replace and delete one key while readers keep reading it. Every
+// read has to return one complete version with its own ETag, never a
+// partially written or mixed one.
+func TestConcurrentPutGetDelete(t *testing.T) {
+	testStorage(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const size = 64 << 10
+	const writers, readers, rounds = 8, 8, 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			version := bytes.Repeat([]byte{byte('a' + i)}, size)
+			for n := 0; n < rounds; n++ {
+				if n%5 == 4 {
+					if w := testRequest(http.MethodDelete, "/bkt/key", nil); w.Code != http.StatusNoContent {
+						t.Errorf("DELETE : %d %s", w.Code, w.Body)
+					}
+					continue
+				}
+				if w := testRequest(http.MethodPut, "/bkt/key", version); w.Code != http.StatusCreated {
+					t.Errorf("PUT : %d %s", w.Code, w.Body)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readersWg sync.WaitGroup
+	var reads, found atomic.Int64
+	for i := 0; i < readers; i++ {
+		readersWg.Add(1)
+		go func() {
+			defer readersWg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				w := testRequest(http.MethodGet, "/bkt/key", nil)
+				reads.Add(1)
+				if w.Code == http.StatusNotFound {
+					continue
+				}
+				body := w.Body.Bytes()
+				if w.Code != http.StatusOK || len(body) != size {
+					t.Errorf("GET : %d, %d bytes", w.Code, len(body))
+					continue
+				}
+				if bytes.Count(body, body[:1]) != size {
+					t.Errorf("GET : mixed content of versions")
+				}
+				if sum := md5.Sum(body); strings.Trim(w.Header().Get("ETag"), `"`) != hex.EncodeToString(sum[:]) {
+					t.Errorf("GET : ETag %s of another version", w.Header().Get("ETag"))
+				}
+				found.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readersWg.Wait()
+
+	if found.Load() == 0 {
+		t.Errorf("none of %d reads found the object", reads.Load())
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Bucket lifecycle configuration
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-lifecycle-mgmt.html
+//
+// Rules are applied by a background worker every -lifecycle_interval.
+// Objects are not versioned, so NoncurrentVersionExpiration is accepted and
+// stored but has nothing to act on.
+
+const (
+	maxLifecycleRules = 1000
+
+	lifecycleEnabled  = "Enabled"
+	lifecycleDisabled = "Disabled"
+)
+
+var lifecycleInterval time.Duration
+
+type XmlLifecycleAnd struct {
+	Prefix                string   `xml:"Prefix,omitempty"`
+	Tags                  []XmlTag `xml:"Tag"`
+	ObjectSizeGreaterThan *int64   `xml:"ObjectSizeGreaterThan"`
+	ObjectSizeLessThan    *int64   `xml:"ObjectSizeLessThan"`
+}
+
+type XmlLifecycleFilter struct {
+	Prefix                *string          `xml:"Prefix"`
+	Tag                   *XmlTag          `xml:"Tag"`
+	ObjectSizeGreaterThan *int64           `xml:"ObjectSizeGreaterThan"`
+	ObjectSizeLessThan    *int64           `xml:"ObjectSizeLessThan"`
+	And                   *XmlLifecycleAnd `xml:"And"`
+}
+
+type XmlLifecycleExpiration struct {
+	Days                      *int   `xml:"Days"`
+	Date                      string `xml:"Date,omitempty"`
+	ExpiredObjectDeleteMarker *bool  `xml:"ExpiredObjectDeleteMarker"`
+}
+
+type XmlNoncurrentVersionExpiration struct {
+	NoncurrentDays          int  `xml:"NoncurrentDays"`
+	NewerNoncurrentVersions *int `xml:"NewerNoncurrentVersions"`
+}
+
+type XmlAbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+}
+
+type XmlLifecycleRule struct {
+	ID                             string                             `xml:"ID,omitempty"`
+	Status                         string                             `xml:"Status"`
+	Prefix                         *string                            `xml:"Prefix"`
+	Filter                         *XmlLifecycleFilter                `xml:"Filter"`
+	Expiration                     *XmlLifecycleExpiration            `xml:"Expiration"`
+	NoncurrentVersionExpiration    *XmlNoncurrentVersionExpiration    `xml:"NoncurrentVersionExpiration"`
+	AbortIncompleteMultipartUpload *XmlAbortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload"`
+}
+
+type XmlLifecycleConfiguration struct {
+	XMLName xml.Name           `xml:"LifecycleConfiguration" json:"-"`
+	Xmlns   string             `xml:"xmlns,attr,omitempty" json:"-"`
+	Rules   []XmlLifecycleRule `xml:"Rule"`
+}
+
+// lifecycleObject is what filters are evaluated against
+type lifecycleObject struct {
+	key     string
+	size    int64
+	modTime time.Time
+	tags    map[string]string
+}
+
+func (f *XmlLifecycleFilter) validate() ErrorCode {
+	set := 0
+	if f.Prefix != nil {
+		set++
+	}
+	if f.Tag != nil {
+		set++
+	}
+	if f.ObjectSizeGreaterThan != nil {
+		set++
+	}
+	if f.ObjectSizeLessThan != nil {
+		set++
+	}
+	if f.And != nil {
+		set++
+	}
+	if set > 1 {
+		// several conditions have to be combined with <And>
+		return ErrMalformedXML
+	}
+
+	if f.And != nil && f.And.ObjectSizeGreaterThan != nil && f.And.ObjectSizeLessThan != nil &&
+		*f.And.ObjectSizeGreaterThan >= *f.And.ObjectSizeLessThan {
+		return ErrInvalidArgument
+	}
+
+	return ErrNone
+}
+
+func (c *XmlLifecycleConfiguration) validate() ErrorCode {
+	if len(c.Rules) == 0 || len(c.Rules) > maxLifecycleRules {
+		return ErrMalformedXML
+	}
+
+	ids := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if len(rule.ID) > 255 || (rule.ID != "" && ids[rule.ID]) {
+			return ErrInvalidArgument
+		}
+		ids[rule.ID] = true
+
+		if rule.Status != lifecycleEnabled && rule.Status != lifecycleDisabled {
+			return ErrMalformedXML
+		}
+
+		if rule.Prefix != nil && rule.Filter != nil {
+			return ErrMalformedXML
+		}
+		if rule.Filter != nil {
+			if code := rule.Filter.validate(); code != ErrNone {
+				return code
+			}
+		}
+
+		if rule.Expiration == nil && rule.NoncurrentVersionExpiration == nil && rule.AbortIncompleteMultipartUpload == nil {
+			return ErrInvalidRequest
+		}
+
+		if e := rule.Expiration; e != nil {
+			if (e.Days != nil) == (e.Date != "") && e.ExpiredObjectDeleteMarker == nil {
+				return ErrMalformedXML
+			}
+			if e.Days != nil && *e.Days <= 0 {
+				return ErrInvalidArgument
+			}
+			if e.Date != "" {
+				date, err := time.Parse(time.RFC3339, e.Date)
+				if err != nil || !date.Equal(date.UTC().Truncate(24*time.Hour)) {
+					// dates must be at midnight UTC
+					return ErrInvalidArgument
+				}
+			}
+		}
+
+		if n := rule.NoncurrentVersionExpiration; n != nil && n.NoncurrentDays <= 0 {
+			return ErrInvalidArgument
+		}
+
+		if a := rule.AbortIncompleteMultipartUpload; a != nil {
+			if a.DaysAfterInitiation <= 0 {
+				return ErrInvalidArgument
+			}
+			// tag based filters can't be used with incomplete uploads
+			if f := rule.Filter; f != nil && (f.Tag != nil || (f.And != nil && len(f.And.Tags) > 0)) {
+				return ErrInvalidRequest
+			}
+		}
+	}
+
+	return ErrNone
+}
+
+// prefix returns key prefix the rule applies to
+func (rule *XmlLifecycleRule) prefix() string {
+	switch {
+	case rule.Prefix != nil:
+		return *rule.Prefix
+	case rule.Filter == nil:
+		return ""
+	case rule.Filter.Prefix != nil:
+		return *rule.Filter.Prefix
+	case rule.Filter.And != nil:
+		return rule.Filter.And.Prefix
+	}
+	return ""
+}
+
+func (rule *XmlLifecycleRule) matches(obj *lifecycleObject) bool {
+	if !strings.HasPrefix(obj.key, rule.prefix()) {
+		return false
+	}
+
+	f := rule.Filter
+	if f == nil {
+		return true
+	}
+
+	var tags []XmlTag
+	greaterThan, lessThan := f.ObjectSizeGreaterThan, f.ObjectSizeLessThan
+	if f.Tag != nil {
+		tags = append(tags, *f.Tag)
+	}
+	if f.And != nil {
+		tags = append(tags, f.And.Tags...)
+		greaterThan, lessThan = f.And.ObjectSizeGreaterThan, f.And.ObjectSizeLessThan
+	}
+
+	for _, tag := range tags {
+		if value, ok := obj.tags[tag.Key]; !ok || value != tag.Value {
+			return false
+		}
+	}
+
+	if greaterThan != nil && obj.size <= *greaterThan {
+		return false
+	}
+	if lessThan != nil && obj.size >= *lessThan {
+		return false
+	}
+
+	return true
+}
+
+// expirationTime returns when object expires according to the rule (zero
+// time if it does not). Like in S3, day counts are rounded up to the next
+// midnight UTC.
+func (rule *XmlLifecycleRule) expirationTime(modTime time.Time) time.Time {
+	e := rule.Expiration
+	if e == nil {
+		return time.Time{}
+	}
+
+	if e.Date != "" {
+		date, _ := time.Parse(time.RFC3339, e.Date)
+		return date
+	}
+
+	if e.Days == nil {
+		return time.Time{}
+	}
+	return midnightAfter(modTime.UTC().AddDate(0, 0, *e.Days))
+}
+
+func midnightAfter(t time.Time) time.Time {
+	midnight := t.UTC().Truncate(24 * time.Hour)
+	if midnight.Before(t) {
+		midnight = midnight.Add(24 * time.Hour)
+	}
+	return midnight
+}
+
+func loadLifecycleObject(bucketName string, objectKey string, info fs.FileInfo) *lifecycleObject {
+	obj := &lifecycleObject{key: objectKey, size: info.Size(), modTime: info.ModTime()}
+	if meta := loadObjectMeta(bucketName, objectKey, info); meta != nil {
+		obj.tags = meta.Tags
+		if meta.Encryption != nil {
+			obj.size = meta.Encryption.Size
+		}
+	}
+	return obj
+}
+
+// startLifecycleWorker applies lifecycle rules of all buckets periodically
+func startLifecycleWorker() {
+	if lifecycleInterval <= 0 {
+		log.Printf("Lifecycle worker disabled")
+		return
+	}
+
+	go func() {
+		for {
+			runLifecycle(time.Now())
+			time.Sleep(lifecycleInterval)
+		}
+	}()
+}
+
+func runLifecycle(now time.Time) {
+	entries, err := os.ReadDir(bucketPath)
+	if err != nil {
+		log.Printf("Lifecycle: can't read %s : %s", bucketPath, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !isSafeBucketName(entry.Name()) {
+			continue
+		}
+
+		config := loadBucketMeta(entry.Name()).Lifecycle
+		if config == nil {
+			continue
+		}
+		applyLifecycle(entry.Name(), config, now)
+	}
+}
+
+func applyLifecycle(bucketName string, config *XmlLifecycleConfiguration, now time.Time) {
+	var rules []*XmlLifecycleRule
+	for i := range config.Rules {
+		if config.Rules[i].Status == lifecycleEnabled {
+			rules = append(rules, &config.Rules[i])
+		}
+	}
+
+	// incomplete multipart uploads
+	for _, upload := range bucketUploads(bucketName) {
+		for _, rule := range rules {
+			abort := rule.AbortIncompleteMultipartUpload
+			if abort == nil || !strings.HasPrefix(upload.Key, rule.prefix()) {
+				continue
+			}
+			if now.Before(midnightAfter(upload.Initiated.AddDate(0, 0, abort.DaysAfterInitiation))) {
+				continue
+			}
+
+			filePath, code := resolveObjectPath(bucketName, upload.Key)
+			if code != ErrNone {
+				continue
+			}
+			removed := removeUploadParts(bucketName, filePath, upload.UploadId)
+			removeMultipartUpload(upload.UploadId)
+			metricLifecycleActions.add(metricLabels("action", "abort_upload"), 1)
+			log.Printf("Lifecycle: rule %q aborted upload %s of %s/%s (%d parts removed)",
+				rule.ID, upload.UploadId, bucketName, upload.Key, removed)
+			break
+		}
+	}
+
+	// expiration of current objects, objects are removed once the walk is over
+	type expiration struct {
+		obj  *lifecycleObject
+		rule *XmlLifecycleRule
+	}
+	var expired []expiration
+	walkBucketObjects(bucketName, func(objectKey string, path string, info fs.FileInfo) {
+		obj := loadLifecycleObject(bucketName, objectKey, info)
+		for _, rule := range rules {
+			expires := rule.expirationTime(obj.modTime)
+			if expires.IsZero() || now.Before(expires) || !rule.matches(obj) {
+				continue
+			}
+			expired = append(expired, expiration{obj, rule})
+			break
+		}
+	})
+
+	for _, e := range expired {
+		obj, rule := e.obj, e.rule
+		filePath, code := resolveObjectPath(bucketName, obj.key)
+		if code != ErrNone {
+			continue
+		}
+
+		// object rewritten since it was looked at is left for the next run,
+		// locked objects do not expire
+		removed, err := removeObject(bucketName, obj.key, filePath, func(fstat os.FileInfo) bool {
+			if !fstat.ModTime().Equal(obj.modTime) {
+				return true
+			}
+			if meta := loadObjectMeta(bucketName, obj.key, fstat); meta != nil && meta.lockError(false) != ErrNone {
+				log.Printf("Lifecycle: rule %q skipped locked %s/%s", rule.ID, bucketName, obj.key)
+				return true
+			}
+			return false
+		})
+		if err != nil {
+			log.Printf("Lifecycle: rule %q failed to expire %s/%s : %s", rule.ID, bucketName, obj.key, err)
+			continue
+		}
+		if removed {
+			metricLifecycleActions.add(metricLabels("action", "expire"), 1)
+			log.Printf("Lifecycle: rule %q expired %s/%s", rule.ID, bucketName, obj.key)
+		}
+	}
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketLifecycleConfiguration.html
+func putBucketLifecycle(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var config XmlLifecycleConfiguration
+	if err = xml.Unmarshal(body, &config); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	if code := config.validate(); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	err = updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Lifecycle = &config
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving lifecycle configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLifecycleConfiguration.html
+func getBucketLifecycle(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	config := loadBucketMeta(bucketName).Lifecycle
+	if config == nil {
+		s3err(w, ErrNoSuchLifecycleConfiguration)
+		return nil
+	}
+
+	config.Xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+	return writeXML(w, config)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketLifecycle.html
+func deleteBucketLifecycle(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	err := updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Lifecycle = nil
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error removing lifecycle configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
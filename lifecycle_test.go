@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLifecycleTagRule = `<LifecycleConfiguration><Rule><ID>tmp</ID><Status>Enabled</Status>
+<Filter><Tag><Key>retain</Key><Value>no</Value></Tag></Filter><Expiration><Days>1</Days></Expiration>
+</Rule></LifecycleConfiguration>`
+
+// Tag filters match tags stored by PutObject x-amz-tagging
+func TestLifecycleTagFilter(t *testing.T) {
+	testStorage(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for key, tagging := range map[string]string{"old": "retain=no", "kept": "retain=yes", "plain": ""} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/bkt/"+key, strings.NewReader(key))
+		if tagging != "" {
+			r.Header.Set("x-amz-tagging", tagging)
+		}
+		if handlePutRequest(w, r); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s : %d %s", key, w.Code, w.Body)
+		}
+	}
+
+	if w := testRequest(http.MethodPut, "/bkt?lifecycle", []byte(testLifecycleTagRule)); w.Code != http.StatusOK {
+		t.Fatalf("PutBucketLifecycleConfiguration : %d %s", w.Code, w.Body)
+	}
+	applyLifecycle("bkt", loadBucketMeta("bkt").Lifecycle, time.Now().AddDate(0, 0, 3))
+
+	for key, code := range map[string]int{"old": http.StatusNotFound, "kept": http.StatusOK, "plain": http.StatusOK} {
+		if w := testRequest(http.MethodGet, "/bkt/"+key, nil); w.Code != code {
+			t.Errorf("GET %s after lifecycle : %d, expected %d", key, w.Code, code)
+		}
+	}
+}
+
+// objects are not versioned, NoncurrentVersionExpiration is stored but never
+// expires anything
+func TestLifecycleNoncurrentVersionExpiration(t *testing.T) {
+	testStorage(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/bkt/old", strings.NewReader("old"))
+	r.Header.Set("x-amz-tagging", "retain=no")
+	if handlePutRequest(w, r); w.Code != http.StatusCreated {
+		t.Fatalf("PUT : %d %s", w.Code, w.Body)
+	}
+
+	rule := strings.Replace(testLifecycleTagRule, "<Expiration><Days>1</Days></Expiration>",
+		"<NoncurrentVersionExpiration><NoncurrentDays>1</NoncurrentDays></NoncurrentVersionExpiration>", 1)
+	if w := testRequest(http.MethodPut, "/bkt?lifecycle", []byte(rule)); w.Code != http.StatusOK {
+		t.Fatalf("PutBucketLifecycleConfiguration with NoncurrentVersionExpiration : %d %s", w.Code, w.Body)
+	}
+
+	w = testRequest(http.MethodGet, "/bkt?lifecycle", nil)
+	var config XmlLifecycleConfiguration
+	if err := xml.Unmarshal(w.Body.Bytes(), &config); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GetBucketLifecycleConfiguration : %d %s", w.Code, w.Body)
+	}
+	if len(config.Rules) != 1 || config.Rules[0].NoncurrentVersionExpiration == nil ||
+		config.Rules[0].NoncurrentVersionExpiration.NoncurrentDays != 1 || config.Rules[0].Expiration != nil {
+		t.Errorf("GetBucketLifecycleConfiguration : %s", w.Body)
+	}
+
+	applyLifecycle("bkt", loadBucketMeta("bkt").Lifecycle, time.Now().AddDate(0, 0, 3))
+	if w := testRequest(http.MethodGet, "/bkt/old", nil); w.Code != http.StatusOK {
+		t.Errorf("GET after lifecycle : %d", w.Code)
+	}
+}
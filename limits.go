@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate limits are token buckets for requests per second and upload/download
+// bytes per second - globally, per access key and per client IP. A request
+// over the request rate, or arriving while bandwidth of its scope is more
+// than a second behind, gets SlowDown (503). Transfers in progress are slowed
+// down to the bandwidth limits rather than cut off.
+
+var (
+	rateLimitSpec    string // global
+	rateLimitKeySpec string // default of every access key
+	rateLimitIPSpec  string
+	maxObjectSize    byteSize // 0 is unlimited
+	maxHeaderSize    byteSize
+)
+
+// limitSettings are limit flags resolved against configuration file
+type limitSettings struct {
+	rateLimit     string
+	rateLimitKey  string
+	rateLimitIP   string
+	maxObjectSize byteSize
+}
+
+// flagLimitSettings returns limit settings in force
+func flagLimitSettings() limitSettings {
+	return limitSettings{rateLimitSpec, rateLimitKeySpec, rateLimitIPSpec, maxObjectSize}
+}
+
+// apply makes settings accepted by buildLimits the ones in force
+func (s limitSettings) apply() {
+	rateLimitSpec, rateLimitKeySpec, rateLimitIPSpec, maxObjectSize = s.rateLimit, s.rateLimitKey, s.rateLimitIP, s.maxObjectSize
+}
+
+// limiterIdleTime is how long per-key/per-IP limiters are kept unused
+const limiterIdleTime = 5 * time.Minute
+
+// byteSize is a flag value like "1048576", "512KiB", "10MB" or "5GiB"
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	number := strings.TrimSpace(value)
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}, {"B", 1},
+	}
+
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, factor = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size \"%s\"", value)
+	}
+	*s = byteSize(n * float64(factor))
+	return nil
+}
+
+// rateLimit is a limit spec like "rps=50,up=10MiB,down=20MiB" (0 or missing is unlimited)
+type rateLimit struct {
+	rps  float64
+	up   float64 // bytes per second
+	down float64
+}
+
+func parseRateLimit(spec string) (rateLimit, error) {
+	var limit rateLimit
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(item, "=")
+		var err error
+		switch strings.TrimSpace(name) {
+		case "rps":
+			if limit.rps, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && limit.rps < 0 {
+				err = fmt.Errorf("negative rate")
+			}
+		case "up", "down":
+			var size byteSize
+			if err = size.Set(value); err == nil && name == "up" {
+				limit.up = float64(size)
+			} else if err == nil {
+				limit.down = float64(size)
+			}
+		default:
+			err = fmt.Errorf("unknown limit (expected rps, up or down)")
+		}
+		if err != nil {
+			return limit, fmt.Errorf("invalid rate limit \"%s\" : %s", item, err)
+		}
+	}
+	return limit, nil
+}
+
+func (l rateLimit) isZero() bool {
+	return l == rateLimit{}
+}
+
+// tokenBucket holds up to one second worth of tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	tokens float64 // negative when in debt
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// refill adds tokens for the time passed (mu must be held)
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes one token if there is one
+func (b *tokenBucket) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// behind reports whether more than a second worth of tokens is owed
+func (b *tokenBucket) behind() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens < -b.rate
+}
+
+// spend takes n tokens, going into debt if needed, and returns how long to
+// wait until the debt is paid
+func (b *tokenBucket) spend(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limiter applies rateLimit to one scope (everything, an access key or an IP)
+type limiter struct {
+	requests *tokenBucket
+	up       *tokenBucket
+	down     *tokenBucket
+	used     atomic.Int64 // unix nanoseconds
+}
+
+func newLimiter(limit rateLimit) *limiter {
+	if limit.isZero() {
+		return nil
+	}
+	return &limiter{requests: newTokenBucket(limit.rps), up: newTokenBucket(limit.up), down: newTokenBucket(limit.down)}
+}
+
+// admit takes request token of the scope, ErrNone if the request may proceed
+func (l *limiter) admit() ErrorCode {
+	if l == nil {
+		return ErrNone
+	}
+	l.used.Store(time.Now().UnixNano())
+
+	if l.up.behind() || l.down.behind() {
+		return ErrRequestBytesExceed
+	}
+	if !l.requests.take() {
+		return ErrTooManyRequest
+	}
+	return ErrNone
+}
+
+// admitRequest checks request against limiter of the scope, answering
+// SlowDown if it is over the limit
+func admitRequest(w http.ResponseWriter, scope string, l *limiter) bool {
+	code := l.admit()
+	if code == ErrNone {
+		return true
+	}
+	metricThrottled.add(metricLabels("scope", scope), 1)
+	s3err(w, code)
+	return false
+}
+
+// requestLimits are limits in force, replaced as a whole on config reload
+type requestLimits struct {
+	maxObjectSize int64
+	global        *limiter
+	keyLimit      rateLimit
+	keyLimits     map[string]rateLimit // access keys with limits of their own
+	ipLimit       rateLimit
+
+	mu        sync.Mutex
+	keys      map[string]*limiter
+	ips       map[string]*limiter
+	lastSweep time.Time
+}
+
+var activeLimits atomic.Pointer[requestLimits]
+
+// buildLimits parses limit settings and per-user limits of config users
+func buildLimits(settings limitSettings, users []ConfigUser) (*requestLimits, error) {
+	limits := &requestLimits{
+		maxObjectSize: int64(settings.maxObjectSize),
+		keyLimits:     map[string]rateLimit{},
+		keys:          map[string]*limiter{},
+		ips:           map[string]*limiter{},
+		lastSweep:     time.Now(),
+	}
+
+	global, err := parseRateLimit(settings.rateLimit)
+	if err != nil {
+		return nil, err
+	}
+	limits.global = newLimiter(global)
+	if limits.keyLimit, err = parseRateLimit(settings.rateLimitKey); err != nil {
+		return nil, err
+	}
+	if limits.ipLimit, err = parseRateLimit(settings.rateLimitIP); err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.RateLimit == "" {
+			continue
+		}
+		if limits.keyLimits[user.AccessKeyId], err = parseRateLimit(user.RateLimit); err != nil {
+			return nil, fmt.Errorf("user %s : %w", user.AccessKeyId, err)
+		}
+	}
+	return limits, nil
+}
+
+// scoped returns limiter of the key or IP, creating it on first use
+func (limits *requestLimits) scoped(scopes map[string]*limiter, name string, limit rateLimit) *limiter {
+	if limit.isZero() {
+		return nil
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	// limiters unused for a while have their buckets full again, so they
+	// can be dropped without loss
+	if time.Since(limits.lastSweep) > limiterIdleTime {
+		idle := time.Now().Add(-limiterIdleTime).UnixNano()
+		for _, m := range []map[string]*limiter{limits.keys, limits.ips} {
+			for n, l := range m {
+				if l.used.Load() < idle {
+					delete(m, n)
+				}
+			}
+		}
+		limits.lastSweep = time.Now()
+	}
+
+	l := scopes[name]
+	if l == nil {
+		l = newLimiter(limit)
+		scopes[name] = l
+	}
+	return l
+}
+
+func (limits *requestLimits) forKey(accessKeyId string) *limiter {
+	limit, ok := limits.keyLimits[accessKeyId]
+	if !ok {
+		limit = limits.keyLimit
+	}
+	return limits.scoped(limits.keys, accessKeyId, limit)
+}
+
+func (limits *requestLimits) forIP(ip string) *limiter {
+	return limits.scoped(limits.ips, ip, limits.ipLimit)
+}
+
+// objectSizeLimit returns maximal object (and part) size, 0 if unlimited
+func objectSizeLimit() int64 {
+	return activeLimits.Load().maxObjectSize
+}
+
+// bandwidthBuckets returns upload or download buckets of the limiters
+func bandwidthBuckets(upload bool, limiters ...*limiter) []*tokenBucket {
+	var buckets []*tokenBucket
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		b := l.down
+		if upload {
+			b = l.up
+		}
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// throttle waits until n bytes transferred fit bandwidth limits (or the
+// request is canceled)
+func throttle(ctx context.Context, buckets []*tokenBucket, n int) {
+	var wait time.Duration
+	for _, b := range buckets {
+		wait = max(wait, b.spend(n))
+	}
+	if wait <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// throttledBody slows down reading of request body to upload limits
+type throttledBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		throttle(b.ctx, b.buckets, n)
+	}
+	return n, err
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
@@ -9,9 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +18,7 @@ import (
 var (
 	bucketPath   string
 	uploadsPath  string
+	metaPath     string
 	cfgPath      string
 	s3user       string
 	userId       string
@@ -37,47 +35,37 @@ type BucketListResponse struct {
 }
 
 type Config struct {
-	XMLName         xml.Name `xml:"root"`
-	AccessKeyId     string   `xml:"AccessKeyId"`
-	SecretAccessKey string   `xml:"SecretAccessKey"`
-	Region          string   `xml:"Region"`
-	Port            int      `xml:"Port"`
-	UploadsPath     string   `xml:"UploadsPath"`
-	BucketsPath     string   `xml:"BucketsPath"`
-}
-
-func loadConfig(path string) (Config, error) {
-	var cfg Config
-	log.Printf("Reading configuration from %s...\n", cfgPath)
-
-	// Open the XML file
-	file, err := os.Open(path)
-	if err != nil {
-		log.Printf("Error opening config file %s , err: %s\n", path, err)
-		return cfg, err
-	}
-	defer file.Close()
-
-	// Create a new decoder
-	decoder := xml.NewDecoder(file)
-
-	// Decode the XML data into the Person struct
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		log.Printf("Error parsing config file (%s) : %s \n", path, err)
-		return cfg, err
-	}
-
-	return cfg, nil
-}
-
-func isFlagOn(name string) bool {
-	for _, str := range os.Args {
-		if str == "-"+name {
-			return true
-		}
-	}
-	return false
+	XMLName           xml.Name     `xml:"root" json:"-" yaml:"-" toml:"-"`
+	AccessKeyId       string       `xml:"AccessKeyId" json:"AccessKeyId" yaml:"AccessKeyId" toml:"AccessKeyId"`
+	SecretAccessKey   string       `xml:"SecretAccessKey" json:"SecretAccessKey" yaml:"SecretAccessKey" toml:"SecretAccessKey"`
+	Region            string       `xml:"Region" json:"Region" yaml:"Region" toml:"Region"`
+	Port              int          `xml:"Port" json:"Port" yaml:"Port" toml:"Port"`
+	UploadsPath       string       `xml:"UploadsPath" json:"UploadsPath" yaml:"UploadsPath" toml:"UploadsPath"`
+	BucketsPath       string       `xml:"BucketsPath" json:"BucketsPath" yaml:"BucketsPath" toml:"BucketsPath"`
+	MetaPath          string       `xml:"MetaPath" json:"MetaPath" yaml:"MetaPath" toml:"MetaPath"`
+	Durability        string       `xml:"Durability" json:"Durability" yaml:"Durability" toml:"Durability"`
+	KeyEncoding       string       `xml:"KeyEncoding" json:"KeyEncoding" yaml:"KeyEncoding" toml:"KeyEncoding"`
+	LifecycleInterval string       `xml:"LifecycleInterval" json:"LifecycleInterval" yaml:"LifecycleInterval" toml:"LifecycleInterval"`
+	SSEMasterKeyFile  string       `xml:"SSEMasterKeyFile" json:"SSEMasterKeyFile" yaml:"SSEMasterKeyFile" toml:"SSEMasterKeyFile"`
+	SSECAllowHTTP     bool         `xml:"SSECAllowHTTP" json:"SSECAllowHTTP" yaml:"SSECAllowHTTP" toml:"SSECAllowHTTP"`
+	TLSCertFile       string       `xml:"TLSCertFile" json:"TLSCertFile" yaml:"TLSCertFile" toml:"TLSCertFile"`
+	TLSKeyFile        string       `xml:"TLSKeyFile" json:"TLSKeyFile" yaml:"TLSKeyFile" toml:"TLSKeyFile"`
+	TLSClientCAFile   string       `xml:"TLSClientCAFile" json:"TLSClientCAFile" yaml:"TLSClientCAFile" toml:"TLSClientCAFile"`
+	TLSPort           int          `xml:"TLSPort" json:"TLSPort" yaml:"TLSPort" toml:"TLSPort"`
+	VHostDomains      []string     `xml:"VHostDomains>Domain" json:"VHostDomains" yaml:"VHostDomains" toml:"VHostDomains"`
+	AccessLog         string       `xml:"AccessLog" json:"AccessLog" yaml:"AccessLog" toml:"AccessLog"`
+	AccessLogFormat   string       `xml:"AccessLogFormat" json:"AccessLogFormat" yaml:"AccessLogFormat" toml:"AccessLogFormat"`
+	AccessLogDelivery string       `xml:"AccessLogDelivery" json:"AccessLogDelivery" yaml:"AccessLogDelivery" toml:"AccessLogDelivery"`
+	AdminPort         int          `xml:"AdminPort" json:"AdminPort" yaml:"AdminPort" toml:"AdminPort"`
+	MetricsInterval   string       `xml:"MetricsInterval" json:"MetricsInterval" yaml:"MetricsInterval" toml:"MetricsInterval"`
+	ReadyMinFreeMB    int          `xml:"ReadyMinFreeMB" json:"ReadyMinFreeMB" yaml:"ReadyMinFreeMB" toml:"ReadyMinFreeMB"`
+	ShutdownTimeout   string       `xml:"ShutdownTimeout" json:"ShutdownTimeout" yaml:"ShutdownTimeout" toml:"ShutdownTimeout"`
+	RateLimit         string       `xml:"RateLimit" json:"RateLimit" yaml:"RateLimit" toml:"RateLimit"`
+	RateLimitKey      string       `xml:"RateLimitKey" json:"RateLimitKey" yaml:"RateLimitKey" toml:"RateLimitKey"`
+	RateLimitIP       string       `xml:"RateLimitIP" json:"RateLimitIP" yaml:"RateLimitIP" toml:"RateLimitIP"`
+	MaxObjectSize     string       `xml:"MaxObjectSize" json:"MaxObjectSize" yaml:"MaxObjectSize" toml:"MaxObjectSize"`
+	MaxHeaderSize     string       `xml:"MaxHeaderSize" json:"MaxHeaderSize" yaml:"MaxHeaderSize" toml:"MaxHeaderSize"`
+	Users             []ConfigUser `xml:"Users>User" json:"Users" yaml:"Users" toml:"Users"`
 }
 
 func main() {
@@ -86,6 +74,31 @@ func main() {
 	flag.Int64Var(&svcPort, "p", 8080, "Port to listen on")
 	flag.StringVar(&uploadsPath, "dir_uploads", "./uploads/", "temp dir to store upload parts")
 	flag.StringVar(&bucketPath, "dir_buckets", "./buckets/", "dir to store buckets")
+	flag.StringVar(&metaPath, "dir_meta", "./meta/", "dir to store object metadata")
+	flag.StringVar(&durability, "durability", durabilityFile, "fsync policy for object writes: none, file (fsync data) or full (fsync data and parent dir)")
+	flag.StringVar(&keyEncoding, "key_encoding", keyEncodingStrict, "keys the filesystem can't represent: strict (reject) or encode (map onto reserved file names)")
+	flag.DurationVar(&lifecycleInterval, "lifecycle_interval", time.Hour, "how often lifecycle rules are applied (0 disables)")
+	flag.StringVar(&sseMasterKeyPath, "sse_master_key", "", "master key file for server-side encryption (created if missing, empty disables encryption)")
+	flag.BoolVar(&sseRotateKey, "sse_rotate_key", false, "add a new master key, re-wrap data keys of all objects with it and exit")
+	flag.BoolVar(&ssecAllowHTTP, "ssec_allow_http", false, "accept customer-provided encryption keys (SSE-C) over plain HTTP")
+	flag.StringVar(&tlsCertPath, "tls_cert", "", "TLS certificate file (PEM), enables HTTPS")
+	flag.StringVar(&tlsKeyPath, "tls_key", "", "TLS private key file (PEM)")
+	flag.StringVar(&tlsClientCAPath, "tls_client_ca", "", "CA certificates (PEM) client certificates must be signed by (enables mutual TLS)")
+	flag.Int64Var(&tlsPort, "tls_port", 0, "port for HTTPS when plain HTTP is served on -p as well (0: -p serves HTTPS only)")
+	flag.StringVar(&vhostDomainList, "vhost_domains", "", "comma-separated base domains for virtual-hosted-style requests (<bucket>.<domain>)")
+	flag.StringVar(&accessLogPath, "access_log", "", "access log file (\"-\" for stdout, empty disables)")
+	flag.StringVar(&accessLogFormat, "access_log_format", accessLogFormatS3, "access log format: s3 (S3 server access log) or json (JSON lines)")
+	flag.DurationVar(&accessLogDelivery, "access_log_delivery", 5*time.Minute, "how often access logs are delivered into target buckets of PutBucketLogging (0 disables)")
+	flag.Int64Var(&adminPort, "admin_port", 0, "port of admin listener serving /metrics, /healthz, /readyz, /admin/info and /debug/pprof (0 disables)")
+	flag.Int64Var(&readyMinFree, "ready_min_free_mb", 64, "free space (MiB) of data dirs below which /readyz reports not ready")
+	flag.DurationVar(&metricsScanInterval, "metrics_interval", 5*time.Minute, "how often per-bucket object count and size metrics are computed (0 disables)")
+	flag.DurationVar(&shutdownTimeout, "shutdown_timeout", 30*time.Second, "how long requests in flight may take to complete on SIGTERM/SIGINT before their connections are closed")
+	flag.StringVar(&rateLimitSpec, "rate_limit", "", "global rate limit: requests and upload/download bytes per second, e.g. \"rps=500,up=200MiB,down=400MiB\" (empty is unlimited)")
+	flag.StringVar(&rateLimitKeySpec, "rate_limit_key", "", "rate limit of every access key (users in config may have their own RateLimit)")
+	flag.StringVar(&rateLimitIPSpec, "rate_limit_ip", "", "rate limit of every client IP")
+	flag.Var(&maxObjectSize, "max_object_size", "maximal size of objects and parts, e.g. 5GiB (0 is unlimited)")
+	maxHeaderSize = http.DefaultMaxHeaderBytes
+	flag.Var(&maxHeaderSize, "max_header_size", "maximal size of request headers")
 	flag.StringVar(&s3user, "user_name", "s3user@amazon.com", "AWS S3 user name")
 	flag.StringVar(&userId, "user_id", uuid.New().String(), "AWS S3 user ID")
 	flag.StringVar(&keyId, "key_id", genBase64Str(10), "Access Key ID")
@@ -101,8 +114,19 @@ func main() {
 		return
 	}
 
-	//first try load config .. Command line args override config values
+	if err := applyEnvFlags(); err != nil {
+		log.Fatalf("Error in environment : %s", err)
+	}
+
+	//first try load config .. Command line args and environment override config values
 	cfg, err := loadConfig(cfgPath)
+	if err != nil && (!os.IsNotExist(err) || isFlagOn("config")) {
+		log.Fatalf("Error loading config file %s : %s", cfgPath, err)
+	} else if err != nil {
+		log.Printf("No config file %s, using flags and environment only", cfgPath)
+	}
+
+	limitConfig := flagLimitSettings()
 
 	if err == nil {
 
@@ -126,13 +150,139 @@ func main() {
 			bucketPath = cfg.BucketsPath
 		}
 
+		if cfg.MetaPath != "" && !isFlagOn("dir_meta") {
+			metaPath = cfg.MetaPath
+		}
+
+		if cfg.Durability != "" && !isFlagOn("durability") {
+			durability = cfg.Durability
+		}
+
+		if cfg.KeyEncoding != "" && !isFlagOn("key_encoding") {
+			keyEncoding = cfg.KeyEncoding
+		}
+
+		if cfg.LifecycleInterval != "" && !isFlagOn("lifecycle_interval") {
+			if lifecycleInterval, err = time.ParseDuration(cfg.LifecycleInterval); err != nil {
+				log.Fatalf("Invalid LifecycleInterval \"%s\" : %s", cfg.LifecycleInterval, err)
+			}
+		}
+
+		if cfg.SSEMasterKeyFile != "" && !isFlagOn("sse_master_key") {
+			sseMasterKeyPath = cfg.SSEMasterKeyFile
+		}
+
+		if cfg.SSECAllowHTTP && !isFlagOn("ssec_allow_http") {
+			ssecAllowHTTP = true
+		}
+
+		if cfg.TLSCertFile != "" && !isFlagOn("tls_cert") {
+			tlsCertPath = cfg.TLSCertFile
+		}
+
+		if cfg.TLSKeyFile != "" && !isFlagOn("tls_key") {
+			tlsKeyPath = cfg.TLSKeyFile
+		}
+
+		if cfg.TLSClientCAFile != "" && !isFlagOn("tls_client_ca") {
+			tlsClientCAPath = cfg.TLSClientCAFile
+		}
+
+		if int64(cfg.TLSPort) != 0 && !isFlagOn("tls_port") {
+			tlsPort = int64(cfg.TLSPort)
+		}
+
+		if len(cfg.VHostDomains) > 0 && !isFlagOn("vhost_domains") {
+			vhostDomainList = strings.Join(cfg.VHostDomains, ",")
+		}
+
+		if cfg.AccessLog != "" && !isFlagOn("access_log") {
+			accessLogPath = cfg.AccessLog
+		}
+
+		if cfg.AccessLogFormat != "" && !isFlagOn("access_log_format") {
+			accessLogFormat = cfg.AccessLogFormat
+		}
+
+		if int64(cfg.AdminPort) != 0 && !isFlagOn("admin_port") {
+			adminPort = int64(cfg.AdminPort)
+		}
+
+		if int64(cfg.ReadyMinFreeMB) != 0 && !isFlagOn("ready_min_free_mb") {
+			readyMinFree = int64(cfg.ReadyMinFreeMB)
+		}
+
+		if cfg.MetricsInterval != "" && !isFlagOn("metrics_interval") {
+			if metricsScanInterval, err = time.ParseDuration(cfg.MetricsInterval); err != nil {
+				log.Fatalf("Invalid MetricsInterval \"%s\" : %s", cfg.MetricsInterval, err)
+			}
+		}
+
+		if cfg.AccessLogDelivery != "" && !isFlagOn("access_log_delivery") {
+			if accessLogDelivery, err = time.ParseDuration(cfg.AccessLogDelivery); err != nil {
+				log.Fatalf("Invalid AccessLogDelivery \"%s\" : %s", cfg.AccessLogDelivery, err)
+			}
+		}
+
+		if cfg.ShutdownTimeout != "" && !isFlagOn("shutdown_timeout") {
+			if shutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeout); err != nil {
+				log.Fatalf("Invalid ShutdownTimeout \"%s\" : %s", cfg.ShutdownTimeout, err)
+			}
+		}
+
+		if limitConfig, err = limitsConfig(cfg); err != nil {
+			log.Fatalf("Invalid limits in %s : %s", cfgPath, err)
+		}
+
+		if cfg.MaxHeaderSize != "" && !isFlagOn("max_header_size") {
+			if err = maxHeaderSize.Set(cfg.MaxHeaderSize); err != nil {
+				log.Fatalf("Invalid MaxHeaderSize : %s", err)
+			}
+		}
+
 		if cfg.Region != "" && !isFlagOn("region") {
 			s3region = cfg.Region
 		}
 
 		log.Printf("Loaded configuration from %s...", cfgPath)
-		log.Printf("*** Note: command-line arguments take precedence over values from the configuration file")
+		log.Printf("*** Note: command-line arguments and environment take precedence over values from the configuration file")
+		activeConfig = cfg
+	}
+
+	if err = validateSettings(); err != nil {
+		log.Fatalf("Invalid configuration :\n%s", err)
+	}
+
+	vhostDomains = parseVHostDomains(vhostDomainList)
 
+	// additional users from config, primary key is always an admin
+	ids, err := buildIdentities(cfg.Users, keyId, secretKey)
+	if err != nil {
+		log.Fatalf("Invalid users in %s : %s", cfgPath, err)
+	}
+	setIdentities(ids)
+
+	limits, err := buildLimits(limitConfig, cfg.Users)
+	if err != nil {
+		log.Fatalf("Invalid rate limits : %s", err)
+	}
+	limitConfig.apply()
+	activeLimits.Store(limits)
+
+	if sseMasterKeyPath != "" {
+		if err = loadMasterKeys(sseMasterKeyPath); err != nil {
+			log.Fatalf("Error loading master key file %s : %s", sseMasterKeyPath, err)
+		}
+	}
+
+	if sseRotateKey {
+		if sseMasterKeyPath == "" {
+			log.Fatalf("-sse_rotate_key needs -sse_master_key")
+		}
+		if err = rotateMasterKey(sseMasterKeyPath); err != nil {
+			log.Fatalf("Error rotating master key : %s", err)
+		}
+		return
 	}
 
 	// Create buckets directory if it doesn't exist
@@ -145,22 +295,95 @@ func main() {
 		os.Mkdir(uploadsPath, 0755)
 	}
 
-	// Set up routes
-	http.HandleFunc("/", handleRequest)
+	// Create metadata directory if it doesn't exist
+	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
+		os.Mkdir(metaPath, 0755)
+	}
+
+	startLifecycleWorker()
+
+	if err = openAccessLog(); err != nil {
+		log.Fatalf("Error opening access log %s : %s", accessLogPath, err)
+	}
+	startLogDeliveryWorker()
+
+	// Set up routes. Requests go straight to the handler - http.ServeMux would
+	// redirect paths of keys like "a//b" or "a/../b" to their cleaned version.
+	handler := http.HandlerFunc(handleRequest)
 
 	// Start server
-	log.Printf("S3 server is running on port %d ...", svcPort)
 	log.Printf("uploads dir  %s ...", uploadsPath)
 	log.Printf("buckets dir  %s ...", bucketPath)
+	log.Printf("metadata dir  %s ...", metaPath)
+	log.Printf("durability  %s ...", durability)
+	log.Printf("key encoding  %s ...", keyEncoding)
+	if accessLogPath != "" {
+		log.Printf("access log  %s (%s) ...", accessLogPath, accessLogFormat)
+	}
+	if len(vhostDomains) > 0 {
+		log.Printf("virtual-hosted-style domains  %s ...", strings.Join(vhostDomains, ", "))
+	}
+	if sseEnabled() {
+		log.Printf("encryption master key  %s (%s) ...", sseMasterKeyPath, currentMasterKey().id)
+	}
+	if ssecAllowHTTP {
+		log.Printf("*** Warning: SSE-C keys are accepted over plain HTTP")
+	}
 	log.Printf("access key id  \"%s\" ...", keyId)
+	if len(cfg.Users) > 0 {
+		log.Printf("additional users  %d ...", len(cfg.Users))
+	}
 
-	err = http.ListenAndServe(":"+strconv.FormatInt(svcPort, 10), nil)
-	log.Printf("Exitting (%s) \n", err.Error())
+	if err = serve(handler); err != nil {
+		log.Fatalf("Exitting (%s) \n", err.Error())
+	}
+	log.Printf("Exitting \n")
 }
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+	r = withVirtualHost(r)
+	rw := newRequestWriter(w, r)
+	activeRequests.Add(1)
+	defer activeRequests.Add(-1)
+	metricInFlight.add("", 1)
+	defer observeRequest(rw)
+	defer logAccess(rw)
+	w = rw
+
+	// global and per-IP limits apply before authentication
+	limits := activeLimits.Load()
+	ipLimiter := limits.forIP(remoteIP(r))
+	if !admitRequest(w, "global", limits.global) || !admitRequest(w, "ip", ipLimiter) {
+		return
+	}
+
+	// CORS preflight requests are not signed
+	if r.Method == http.MethodOptions {
+		handleOptionsRequest(w, r)
+		return
+	}
+	setCORSHeaders(w, r)
+
+	identity, err := authenticate(r)
+	if err != nil {
+		metricAuthFailures.add(metricLabels("reason", authFailureReason(err)), 1)
+		s3err(w, ErrAccessDenied)
+		return
+	}
+	r = withIdentity(r, identity)
+	rw.requester = identity.AccessKeyId
 
-	if res, err := authenticate(r); err != nil || !res {
+	keyLimiter := limits.forKey(identity.AccessKeyId)
+	if !admitRequest(w, "key", keyLimiter) {
+		return
+	}
+	if buckets := bandwidthBuckets(true, limits.global, ipLimiter, keyLimiter); len(buckets) > 0 && r.Body != nil {
+		r.Body = &throttledBody{ReadCloser: r.Body, ctx: r.Context(), buckets: buckets}
+	}
+	rw.throttle = bandwidthBuckets(false, limits.global, ipLimiter, keyLimiter)
+
+	if !authorizeRequest(r) {
+		metricAuthFailures.add(metricLabels("reason", "policy_denied"), 1)
 		s3err(w, ErrAccessDenied)
 		return
 	}
@@ -178,7 +401,7 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		handleHeadRequest(w, r)
 
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		s3err(w, ErrMethodNotAllowed)
 	}
 }
 
@@ -186,14 +409,13 @@ func handleHeadRequest(w http.ResponseWriter, r *http.Request) {
 	// Extract bucket name and object key from URL
 	bucketName, objectKey, params := extractBucketAndKey(r)
 
-	if bucketName == "" {
+	if !isSafeBucketName(bucketName) {
 		s3err(w, ErrInvalidBucketName)
 		return
 	}
 
 	// Check if bucket exists
-	bucketPath := filepath.Join(bucketPath, bucketName)
-	_, err := os.Stat(bucketPath)
+	_, err := os.Stat(bucketDir(bucketName))
 	if os.IsNotExist(err) {
 		s3err(w, ErrNoSuchBucket)
 		return
@@ -201,15 +423,21 @@ func handleHeadRequest(w http.ResponseWriter, r *http.Request) {
 
 	// HeadBucketCommand: HEAD /{bucket}
 	if objectKey == "" && params["prefix"] == "" {
+		w.Header().Set("x-amz-bucket-region", bucketRegion(bucketName))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
 	// Construct file path
-	filePath := filepath.Join(bucketPath, objectKey)
+	filePath, code := resolveObjectPath(bucketName, objectKey)
+	if code != ErrNone {
+		s3err(w, code)
+		return
+	}
+
 	// Check if file exists
-	fstat, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
+	fstat, err := os.Stat(objectFilePath(filePath))
+	if os.IsNotExist(err) || (err == nil && !fstat.IsDir() && isDirKey(objectKey)) {
 		s3err(w, ErrNoSuchKey)
 		return
 	}
@@ -221,7 +449,7 @@ func handleHeadRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	getObjectHead(w, r, filePath)
+	getObjectHead(w, r, bucketName, objectKey, filePath)
 
 }
 
@@ -234,33 +462,110 @@ func handleGetRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !isSafeBucketName(bucketName) {
+		s3err(w, ErrInvalidBucketName)
+		return
+	}
+
 	// Check if bucket exists
-	bucketPath := filepath.Join(bucketPath, bucketName)
-	_, err := os.Stat(bucketPath)
+	_, err := os.Stat(bucketDir(bucketName))
 	if os.IsNotExist(err) {
 		s3err(w, ErrNoSuchBucket)
 		return
 	}
 
+	// bucket sub-resources: GET /{bucket}?location etc.
+	if objectKey == "" {
+		query := r.URL.Query()
+		if query.Has("location") {
+			getBucketLocation(w, r, bucketName)
+			return
+		}
+		if query.Has("cors") {
+			getBucketCors(w, r, bucketName)
+			return
+		}
+		if query.Has("lifecycle") {
+			getBucketLifecycle(w, r, bucketName)
+			return
+		}
+		if query.Has("tagging") {
+			getBucketTagging(w, r, bucketName)
+			return
+		}
+		if query.Has("encryption") {
+			getBucketEncryption(w, r, bucketName)
+			return
+		}
+		if query.Has("object-lock") {
+			getObjectLockConfiguration(w, r, bucketName)
+			return
+		}
+		if query.Has("logging") {
+			getBucketLogging(w, r, bucketName)
+			return
+		}
+	}
+
 	// Construct file path
-	filePath := filepath.Join(bucketPath, objectKey)
-	filePath = filepath.Clean(filePath)
+	isPrefix := params != nil && params["prefix"] != ""
+	var filePath string
+	var code ErrorCode
+	if isPrefix {
+		filePath, code = resolvePrefixPath(bucketName, objectKey)
+	} else {
+		filePath, code = resolveObjectPath(bucketName, objectKey)
+	}
+	if code != ErrNone {
+		s3err(w, code)
+		return
+	}
 
 	// Check if file exists
-	fstat, err := os.Stat(filePath)
+	fstat, err := os.Stat(objectFilePath(filePath))
 
-	if err != nil || fstat == nil {
+	// key with trailing slash which is not stored as an object (encode mode)
+	// still lists the directory
+	if err != nil && !isPrefix && strings.HasSuffix(objectKey, "/") {
+		if filePath, code = resolvePrefixPath(bucketName, objectKey); code == ErrNone {
+			fstat, err = os.Stat(filePath)
+		}
+	}
+
+	if err != nil || fstat == nil || (!fstat.IsDir() && !isPrefix && isDirKey(objectKey)) {
 		s3err(w, ErrNoSuchKey)
 		return
 	}
 
 	//If key/prefix  points to a dir -> return list of objects with a given prefix
-	if fstat.IsDir() || (params != nil && params["prefix"] != "") {
-		listObjects(w, r, bucketPath, bucketName, objectKey)
+	if fstat.IsDir() || isPrefix {
+		listObjects(w, r, bucketName, objectKey, filePath)
+		return
+	}
+
+	// GetObjectTagging: GET /{bucket}/{key}?tagging
+	if r.URL.Query().Has("tagging") {
+		getObjectTagging(w, r, bucketName, objectKey, filePath)
 		return
 	}
 
-	getObject(w, r, filePath)
+	// GetObjectRetention / GetObjectLegalHold: GET /{bucket}/{key}?retention|legal-hold
+	if r.URL.Query().Has("retention") {
+		getObjectRetention(w, r, bucketName, objectKey, filePath)
+		return
+	}
+	if r.URL.Query().Has("legal-hold") {
+		getObjectLegalHold(w, r, bucketName, objectKey, filePath)
+		return
+	}
+
+	// GetObjectAttributes: GET /{bucket}/{key}?attributes
+	if _, ok := r.URL.Query()["attributes"]; ok {
+		getObjectAttributes(w, r, bucketName, objectKey, filePath)
+		return
+	}
+
+	getObject(w, r, bucketName, objectKey, filePath)
 }
 
 func handlePutRequest(w http.ResponseWriter, r *http.Request) {
@@ -268,24 +573,88 @@ func handlePutRequest(w http.ResponseWriter, r *http.Request) {
 	bucketName, objectKey, _ := extractBucketAndKey(r)
 
 	//Create Bucket request  -  PUT with bucket name and w/o object
-	if bucketName != "" && objectKey == "" {
+	if bucketName != "" && objectKey == "" && !isBucketSubresourceRequest(r) {
 		makeBucket(w, r, bucketName)
 		return
 	}
 
 	// Below is the logics for creating/uploading an opbject
 
+	if !isSafeBucketName(bucketName) {
+		s3err(w, ErrInvalidBucketName)
+		return
+	}
+
 	// Check if bucket exists
-	bucketPath := filepath.Join(bucketPath, bucketName)
-	if _, err := os.Stat(bucketPath); os.IsNotExist(err) {
+	if _, err := os.Stat(bucketDir(bucketName)); os.IsNotExist(err) {
 		s3err(w, ErrNoSuchBucket)
 		return
 	}
 
+	// bucket sub-resources: PUT /{bucket}?cors etc.
+	if objectKey == "" {
+		query := r.URL.Query()
+		if query.Has("cors") {
+			putBucketCors(w, r, bucketName)
+			return
+		}
+		if query.Has("lifecycle") {
+			putBucketLifecycle(w, r, bucketName)
+			return
+		}
+		if query.Has("tagging") {
+			putBucketTagging(w, r, bucketName)
+			return
+		}
+		if query.Has("encryption") {
+			putBucketEncryption(w, r, bucketName)
+			return
+		}
+		if query.Has("object-lock") {
+			putObjectLockConfiguration(w, r, bucketName)
+			return
+		}
+		if query.Has("logging") {
+			putBucketLogging(w, r, bucketName)
+			return
+		}
+	}
+
 	// Write object content to file
-	filePath := filepath.Join(bucketPath, objectKey)
+	filePath, code := resolveObjectPath(bucketName, objectKey)
+	if code != ErrNone {
+		s3err(w, code)
+		return
+	}
+
+	// PutObjectTagging: PUT /{bucket}/{key}?tagging
+	if r.URL.Query().Has("tagging") {
+		putObjectTagging(w, r, bucketName, objectKey, filePath)
+		return
+	}
+
+	// PutObjectRetention / PutObjectLegalHold: PUT /{bucket}/{key}?retention|legal-hold
+	if r.URL.Query().Has("retention") {
+		putObjectRetention(w, r, bucketName, objectKey, filePath)
+		return
+	}
+	if r.URL.Query().Has("legal-hold") {
+		putObjectLegalHold(w, r, bucketName, objectKey, filePath)
+		return
+	}
+
+	// CopyObject: PUT /{bucket}/{key} with x-amz-copy-source
+	if r.Header.Get("x-amz-copy-source") != "" {
+		if _, isMulti, _, _ := isMultiPartUpload(r); isMulti {
+			// UploadPartCopy
+			s3err(w, ErrNotImplemented)
+			return
+		}
+		copyObject(w, r, bucketName, objectKey, filePath)
+		return
+	}
 
-	putObject(w, r, filePath, strings.HasSuffix(objectKey, "/"))
+	putObject(w, r, bucketName, objectKey, filePath, isDirKey(objectKey))
 
 }
 
@@ -293,30 +662,64 @@ func handleDeleteRequest(w http.ResponseWriter, r *http.Request) {
 	// Extract bucket name and object key from URL
 	bucketName, objectKey, _ := extractBucketAndKey(r)
 
+	if !isSafeBucketName(bucketName) {
+		s3err(w, ErrInvalidBucketName)
+		return
+	}
+
 	// Check if bucket exists
-	bucketPath := filepath.Join(bucketPath, bucketName)
-	if _, err := os.Stat(bucketPath); os.IsNotExist(err) {
+	if _, err := os.Stat(bucketDir(bucketName)); os.IsNotExist(err) {
 		s3err(w, ErrNoSuchBucket)
 		return
 	}
 
+	// bucket sub-resources: DELETE /{bucket}?cors etc.
+	if objectKey == "" {
+		query := r.URL.Query()
+		if query.Has("cors") {
+			deleteBucketCors(w, r, bucketName)
+			return
+		}
+		if query.Has("lifecycle") {
+			deleteBucketLifecycle(w, r, bucketName)
+			return
+		}
+		if query.Has("tagging") {
+			deleteBucketTagging(w, r, bucketName)
+			return
+		}
+		if query.Has("encryption") {
+			deleteBucketEncryption(w, r, bucketName)
+			return
+		}
+	}
+
+	// DeleteBucket: DELETE /{bucket}
+	if objectKey == "" {
+		deleteBucket(w, r, bucketName)
+		return
+	}
+
 	// Construct file path
-	filePath := filepath.Join(bucketPath, objectKey)
+	filePath, code := resolveObjectPath(bucketName, objectKey)
+	if code != ErrNone {
+		s3err(w, code)
+		return
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		s3err(w, ErrNoSuchKey)
+	// DeleteObjectTagging: DELETE /{bucket}/{key}?tagging
+	if r.URL.Query().Has("tagging") {
+		deleteObjectTagging(w, r, bucketName, objectKey, filePath)
 		return
 	}
 
-	// Delete bucket/object
-	err := os.Remove(filePath)
-	if err != nil {
-		s3err(w, ErrBucketNotEmpty)
+	//https://docs.aws.amazon.com/AmazonS3/latest/API/API_AbortMultipartUpload.html
+	if _, isMulti, uploadId, _ := isMultiPartUpload(r); isMulti {
+		abortMultipartUpload(w, r, bucketName, objectKey, filePath, uploadId)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	deleteObject(w, r, bucketName, objectKey, filePath)
 }
 
 func handlePostRequest(w http.ResponseWriter, r *http.Request) {
@@ -324,42 +727,29 @@ func handlePostRequest(w http.ResponseWriter, r *http.Request) {
 	// Extract bucket name and object key from URL
 	bucketName, objectKey, _ := extractBucketAndKey(r)
 
+	if !isSafeBucketName(bucketName) {
+		s3err(w, ErrInvalidBucketName)
+		return
+	}
+
 	// Check if bucket exists
-	bucketPath := filepath.Join(bucketPath, bucketName)
-	if _, err := os.Stat(bucketPath); os.IsNotExist(err) {
+	if _, err := os.Stat(bucketDir(bucketName)); os.IsNotExist(err) {
 		s3err(w, ErrNoSuchBucket)
 		return
 	}
 
+	filePath, code := resolveObjectPath(bucketName, objectKey)
+	if code != ErrNone {
+		s3err(w, code)
+		return
+	}
+
 	//Logics for handling Multipart uploads goes below
 
 	//CreateMultipartUpload
 	//https://docs.aws.amazon.com/AmazonS3/latest/API/API_CreateMultipartUpload.html
-	if r.URL.RawQuery == "uploads" {
-
-		s := fmt.Sprintf(`
-		<InitiateMultipartUploadResult>
-			<Bucket>%s</Bucket>
-			<Key>%s</Key>
-			<UploadId>%s</UploadId>
-		</InitiateMultipartUploadResult>
-`, bucketName, EscapeStringForXML(objectKey), strconv.FormatInt(time.Now().UnixNano(), 10))
-
-		// Check if bucket exists
-		filePath := filepath.Join(bucketPath, objectKey)
-		fstat, _ := os.Stat(filePath)
-
-		if fstat != nil && fstat.IsDir() {
-			s3err(w, ErrExistingObjectIsDirectory)
-			return
-		}
-
-		var buffer bytes.Buffer
-		buffer.WriteString(s)
-
-		w.WriteHeader(http.StatusOK)
-		w.Write(buffer.Bytes())
-		log.Printf("Multipart upload intiated for %s  (bucket: %s ; object: %s)", r.URL.Path, bucketName, objectKey)
+	if _, ok := r.URL.Query()["uploads"]; ok {
+		createMultipartUpload(w, r, bucketName, objectKey, filePath)
 		return
 	}
 
@@ -374,7 +764,7 @@ func handlePostRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if regexFinilizeUpload.MatchString(r.URL.RawQuery) {
-		finilizeMultipartUpload(w, r, bucketPath, objectKey)
+		finilizeMultipartUpload(w, r, bucketName, objectKey, filePath)
 		return
 	}
 
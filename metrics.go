@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics served at /metrics of the admin listener (-admin_port)
+// in text exposition format. Other admin endpoints are in admin.go.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	adminPort           int64 // 0 disables admin listener
+	metricsScanInterval time.Duration
+)
+
+// metricLabels formats label pairs ("name", "value", ...) as used in series names
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricVec is a counter or gauge with values by labels
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind string, name string, help string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, values: map[string]float64{}}
+}
+
+func (m *metricVec) add(labels string, delta float64) {
+	m.mu.Lock()
+	m.values[labels] += delta
+	m.mu.Unlock()
+}
+
+// reset replaces all values (gauges computed by background scans)
+func (m *metricVec) reset(values map[string]float64) {
+	m.mu.Lock()
+	m.values = values
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	labels := make([]string, 0, len(m.values))
+	for l := range m.values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		if l == "" {
+			fmt.Fprintf(w, "%s %s\n", m.name, formatMetricValue(m.values[l]))
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, l, formatMetricValue(m.values[l]))
+		}
+	}
+}
+
+type histogram struct {
+	counts []uint64 // by upper bound
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram with series by labels
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(labels string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.series[labels]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := make([]string, 0, len(h.series))
+	for l := range h.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		s := h.series[l]
+		prefix := l
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatMetricValue(bound), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, l, formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, l, s.count)
+	}
+}
+
+var (
+	metricRequests         = newMetricVec("counter", "gos3rve_requests_total", "S3 requests by operation and HTTP status.")
+	metricRequestDuration  = newHistogramVec("gos3rve_request_duration_seconds", "Time to handle S3 requests by operation and HTTP status.", []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+	metricBytesReceived    = newMetricVec("counter", "gos3rve_received_bytes_total", "Bytes of request bodies by operation.")
+	metricBytesSent        = newMetricVec("counter", "gos3rve_sent_bytes_total", "Bytes of response bodies by operation.")
+	metricInFlight         = newMetricVec("gauge", "gos3rve_requests_in_flight", "S3 requests being handled.")
+	metricAuthFailures     = newMetricVec("counter", "gos3rve_auth_failures_total", "Rejected requests by reason.")
+	metricThrottled        = newMetricVec("counter", "gos3rve_throttled_requests_total", "Requests rejected with SlowDown by limit scope (global, ip, key).")
+	metricLifecycleActions = newMetricVec("counter", "gos3rve_lifecycle_actions_total", "Objects expired and uploads aborted by lifecycle rules.")
+	metricUploads          = newMetricVec("gauge", "gos3rve_multipart_uploads", "Multipart uploads in progress by bucket.")
+	metricBucketObjects    = newMetricVec("gauge", "gos3rve_bucket_objects", "Objects by bucket (computed periodically).")
+	metricBucketBytes      = newMetricVec("gauge", "gos3rve_bucket_bytes", "Size of objects by bucket (computed periodically).")
+)
+
+// authFailureReason names the reason of a failed authentication
+func authFailureReason(err error) string {
+	switch err {
+	case errAuthMalformed, errAuthSignedHeaders:
+		return "malformed_authorization"
+	case errAuthUnknownKey:
+		return "unknown_access_key"
+	case errAuthMissingDate, errAuthMalformedDate:
+		return "invalid_date"
+	case errAuthSignatureMismatch:
+		return "signature_mismatch"
+	}
+	return "other"
+}
+
+// observeRequest updates request metrics once the request answered through w is done
+func observeRequest(w *requestWriter) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	operation := s3Operation(w.r)
+
+	labels := metricLabels("operation", operation, "status", strconv.Itoa(status))
+	metricRequests.add(labels, 1)
+	metricRequestDuration.observe(labels, time.Since(w.start).Seconds())
+	metricBytesReceived.add(metricLabels("operation", operation), float64(w.bytesReceived()))
+	metricBytesSent.add(metricLabels("operation", operation), float64(w.bytesSent))
+	metricInFlight.add("", -1)
+}
+
+// bucketUsage is what a walk over a bucket found
+type bucketUsage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	Uploads int64 `json:"multipart_uploads"`
+}
+
+var (
+	bucketUsageMu   sync.Mutex
+	bucketUsageLast map[string]bucketUsage
+	bucketUsageAt   time.Time
+)
+
+// scanBucketUsage walks all buckets
+func scanBucketUsage() (map[string]bucketUsage, error) {
+	entries, err := os.ReadDir(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]bucketUsage{}
+	for _, entry := range entries {
+		bucketName := entry.Name()
+		if !entry.IsDir() || !isSafeBucketName(bucketName) {
+			continue
+		}
+
+		var u bucketUsage
+		walkBucketObjects(bucketName, func(objectKey string, path string, info fs.FileInfo) {
+			u.Objects++
+			u.Bytes += objectSize(bucketName, objectKey, info)
+		})
+		u.Uploads = int64(len(bucketUploads(bucketName)))
+		usage[bucketName] = u
+	}
+	return usage, nil
+}
+
+// lastBucketUsage returns result of the last scan, scanning now if there was none
+func lastBucketUsage() (map[string]bucketUsage, time.Time) {
+	bucketUsageMu.Lock()
+	usage, at := bucketUsageLast, bucketUsageAt
+	bucketUsageMu.Unlock()
+	if usage != nil {
+		return usage, at
+	}
+
+	usage, err := scanBucketUsage()
+	if err != nil {
+		log.Printf("Can't read %s : %s", bucketPath, err)
+	}
+	return usage, time.Now().UTC()
+}
+
+// scanBucketMetrics computes per-bucket gauges
+func scanBucketMetrics() {
+	usage, err := scanBucketUsage()
+	if err != nil {
+		log.Printf("Metrics: can't read %s : %s", bucketPath, err)
+		return
+	}
+
+	objects := map[string]float64{}
+	bytes := map[string]float64{}
+	uploads := map[string]float64{}
+	for bucketName, u := range usage {
+		labels := metricLabels("bucket", bucketName)
+		objects[labels] = float64(u.Objects)
+		bytes[labels] = float64(u.Bytes)
+		uploads[labels] = float64(u.Uploads)
+	}
+
+	metricBucketObjects.reset(objects)
+	metricBucketBytes.reset(bytes)
+	metricUploads.reset(uploads)
+
+	bucketUsageMu.Lock()
+	bucketUsageLast, bucketUsageAt = usage, time.Now().UTC()
+	bucketUsageMu.Unlock()
+}
+
+// startMetricsScanner computes per-bucket gauges periodically
+func startMetricsScanner() {
+	if metricsScanInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			scanBucketMetrics()
+			time.Sleep(metricsScanInterval)
+		}
+	}()
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range []interface{ write(io.Writer) }{
+		metricRequests,
+		metricRequestDuration,
+		metricBytesReceived,
+		metricBytesSent,
+		metricInFlight,
+		metricAuthFailures,
+		metricThrottled,
+		metricLifecycleActions,
+		metricUploads,
+		metricBucketObjects,
+		metricBucketBytes,
+	} {
+		m.write(w)
+	}
+}
+
+// adminMux routes requests of the admin listener
+var adminMux = http.NewServeMux()
+
+// startAdminListener sets up admin endpoints and returns server for the
+// admin listener (-admin_port)
+func startAdminListener(listener net.Listener) *http.Server {
+	adminMux.HandleFunc("/metrics", serveMetrics)
+	registerAdminEndpoints()
+	metricInFlight.add("", 0)
+	startMetricsScanner()
+
+	log.Printf("admin listener (/metrics, /healthz, /readyz, /admin/info, /debug/pprof) on %s ...", listener.Addr())
+	return &http.Server{Handler: adminMux}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MultipartUpload is the record of an upload in progress. It is created by
+// CreateMultipartUpload in dir_uploads and removed once the upload is
+// completed or aborted.
+type MultipartUpload struct {
+	UploadId          string    `json:"uploadId"`
+	Bucket            string    `json:"bucket"`
+	Key               string    `json:"key"`
+	Initiated         time.Time `json:"initiated"`
+	ChecksumAlgorithm string    `json:"checksumAlgorithm,omitempty"`
+	ChecksumType      string    `json:"checksumType,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+	ObjectLockState
+
+	// parts are encrypted with the data key of the upload
+	Encryption *ObjectEncryption `json:"encryption,omitempty"`
+}
+
+// upload ids are generated from time.Now().UnixNano()
+var uploadIdPattern = regexp.MustCompile(`^\d+$`)
+
+func isValidUploadId(uploadId string) bool {
+	return uploadIdPattern.MatchString(uploadId)
+}
+
+func multipartUploadPath(uploadId string) string {
+	return filepath.Join(uploadsPath, uploadId+".json")
+}
+
+func saveMultipartUpload(upload *MultipartUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(multipartUploadPath(upload.UploadId), data)
+}
+
+// loadMultipartUpload returns upload record or nil if there is none
+// (i.e. upload was created by older version of the server)
+func loadMultipartUpload(uploadId string) *MultipartUpload {
+	if !isValidUploadId(uploadId) {
+		return nil
+	}
+
+	data, err := os.ReadFile(multipartUploadPath(uploadId))
+	if err != nil {
+		return nil
+	}
+
+	var upload MultipartUpload
+	if err = json.Unmarshal(data, &upload); err != nil {
+		log.Printf("Ignoring corrupted upload record %s : %s\n", uploadId, err)
+		return nil
+	}
+
+	return &upload
+}
+
+func removeMultipartUpload(uploadId string) {
+	if !isValidUploadId(uploadId) {
+		return
+	}
+
+	err := os.Remove(multipartUploadPath(uploadId))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing upload record %s : %s\n", uploadId, err)
+	}
+}
+
+// removeBucketUploads drops records of uploads in progress into a deleted bucket
+func removeBucketUploads(bucketName string) {
+	for _, upload := range bucketUploads(bucketName) {
+		removeMultipartUpload(upload.UploadId)
+	}
+}
+
+// parts are stored as <uploadId>_<partNumber>_<name> next to the object
+var uploadPartPattern = regexp.MustCompile(`^(\d+)_\d+_`)
+
+// isUploadPart reports whether file name belongs to a part of an upload in progress
+func isUploadPart(name string) bool {
+	m := uploadPartPattern.FindStringSubmatch(name)
+	return m != nil && loadMultipartUpload(m[1]) != nil
+}
+
+// bucketUploads returns records of uploads in progress into the bucket
+func bucketUploads(bucketName string) []*MultipartUpload {
+	entries, err := os.ReadDir(uploadsPath)
+	if err != nil {
+		return nil
+	}
+
+	var uploads []*MultipartUpload
+	for _, entry := range entries {
+		uploadId, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if upload := loadMultipartUpload(uploadId); upload != nil && upload.Bucket == bucketName {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Object Lock (WORM)
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-lock.html
+//
+// Objects are not versioned, so a locked object can be neither deleted nor
+// overwritten until its retention expires and its legal hold is released.
+// GOVERNANCE retention gives way to x-amz-bypass-governance-retention sent by
+// admins or users whose policy allows s3:BypassGovernanceRetention,
+// COMPLIANCE retention can only be extended.
+
+const (
+	lockModeGovernance = "GOVERNANCE"
+	lockModeCompliance = "COMPLIANCE"
+
+	bypassGovernanceHeader = "x-amz-bypass-governance-retention"
+)
+
+// ObjectLockState is retention and legal hold of an object (or of the object
+// a multipart upload is going to create)
+type ObjectLockState struct {
+	LockMode        string     `json:"lockMode,omitempty"`
+	LockRetainUntil *time.Time `json:"lockRetainUntil,omitempty"`
+	LegalHold       bool       `json:"legalHold,omitempty"`
+}
+
+// retained reports whether retention period is still running
+func (s *ObjectLockState) retained() bool {
+	return s.LockRetainUntil != nil && time.Now().Before(*s.LockRetainUntil)
+}
+
+// lockError returns ErrAccessDenied if the object may not be deleted or
+// overwritten
+func (s *ObjectLockState) lockError(bypassGovernance bool) ErrorCode {
+	if s.LegalHold {
+		return ErrAccessDenied
+	}
+	if s.retained() && !(s.LockMode == lockModeGovernance && bypassGovernance) {
+		return ErrAccessDenied
+	}
+	return ErrNone
+}
+
+type XmlDefaultRetention struct {
+	Mode  string `xml:"Mode"`
+	Days  int    `xml:"Days,omitempty"`
+	Years int    `xml:"Years,omitempty"`
+}
+
+type XmlObjectLockRule struct {
+	DefaultRetention XmlDefaultRetention `xml:"DefaultRetention"`
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ObjectLockConfiguration.html
+type XmlObjectLockConfiguration struct {
+	XMLName           xml.Name           `xml:"ObjectLockConfiguration" json:"-"`
+	Xmlns             string             `xml:"xmlns,attr,omitempty" json:"-"`
+	ObjectLockEnabled string             `xml:"ObjectLockEnabled,omitempty"`
+	Rule              *XmlObjectLockRule `xml:"Rule,omitempty"`
+}
+
+func (c *XmlObjectLockConfiguration) validate() ErrorCode {
+	if c.ObjectLockEnabled != "Enabled" {
+		return ErrMalformedXML
+	}
+	if c.Rule == nil {
+		return ErrNone
+	}
+
+	retention := c.Rule.DefaultRetention
+	if retention.Mode != lockModeGovernance && retention.Mode != lockModeCompliance {
+		return ErrMalformedXML
+	}
+	// exactly one of Days and Years
+	if (retention.Days > 0) == (retention.Years > 0) || retention.Days < 0 || retention.Years < 0 {
+		return ErrMalformedXML
+	}
+	return ErrNone
+}
+
+// defaultRetainUntil returns retain-until date for objects created now
+func (c *XmlObjectLockConfiguration) defaultRetainUntil() time.Time {
+	retention := c.Rule.DefaultRetention
+	return time.Now().UTC().AddDate(retention.Years, 0, retention.Days)
+}
+
+type XmlObjectRetention struct {
+	XMLName         xml.Name `xml:"Retention"`
+	Xmlns           string   `xml:"xmlns,attr,omitempty"`
+	Mode            string   `xml:"Mode,omitempty"`
+	RetainUntilDate string   `xml:"RetainUntilDate,omitempty"`
+}
+
+type XmlObjectLegalHold struct {
+	XMLName xml.Name `xml:"LegalHold"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:"Status"`
+}
+
+// bucketObjectLock returns object lock configuration of the bucket (nil if
+// object lock is not enabled)
+func bucketObjectLock(bucketName string) *XmlObjectLockConfiguration {
+	return loadBucketMeta(bucketName).ObjectLock
+}
+
+// canBypassGovernance reports whether the request asks for governance bypass
+// and its signer is allowed to
+func canBypassGovernance(r *http.Request, bucketName string, objectKey string) bool {
+	if !strings.EqualFold(r.Header.Get(bypassGovernanceHeader), "true") {
+		return false
+	}
+
+	id := requestIdentity(r)
+	if id == nil {
+		return false
+	}
+	if id.Admin {
+		return true
+	}
+	return id.Policy != nil && isRequestAllowed(r, "s3:BypassGovernanceRetention", bucketName, objectKey)
+}
+
+// parseRetainUntil parses retain-until date which has to lie in the future
+func parseRetainUntil(value string) (time.Time, ErrorCode) {
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return until, ErrMalformedDate
+	}
+	if !until.After(time.Now()) {
+		return until, ErrInvalidArgument
+	}
+	return until.UTC(), ErrNone
+}
+
+// parseObjectLockHeaders returns lock state requested by x-amz-object-lock-*
+// headers of PutObject, CopyObject and CreateMultipartUpload. Default retention
+// of the bucket applies when no mode is given.
+func parseObjectLockHeaders(r *http.Request, bucketName string) (ObjectLockState, ErrorCode) {
+	var state ObjectLockState
+
+	mode := r.Header.Get("x-amz-object-lock-mode")
+	until := r.Header.Get("x-amz-object-lock-retain-until-date")
+	hold := r.Header.Get("x-amz-object-lock-legal-hold")
+
+	config := bucketObjectLock(bucketName)
+	if config == nil {
+		if mode != "" || until != "" || hold != "" {
+			return state, ErrInvalidRequest
+		}
+		return state, ErrNone
+	}
+
+	if (mode == "") != (until == "") {
+		return state, ErrInvalidRequest
+	}
+
+	if mode != "" {
+		if mode != lockModeGovernance && mode != lockModeCompliance {
+			return state, ErrInvalidArgument
+		}
+		retainUntil, code := parseRetainUntil(until)
+		if code != ErrNone {
+			return state, code
+		}
+		state.LockMode, state.LockRetainUntil = mode, &retainUntil
+	} else if config.Rule != nil {
+		retainUntil := config.defaultRetainUntil()
+		state.LockMode, state.LockRetainUntil = config.Rule.DefaultRetention.Mode, &retainUntil
+	}
+
+	switch hold {
+	case "", "OFF":
+	case "ON":
+		state.LegalHold = true
+	default:
+		return state, ErrInvalidArgument
+	}
+
+	return state, ErrNone
+}
+
+// checkObjectLock returns ErrAccessDenied if the object at path (as returned
+// by objectWritePath) is locked against overwrite. Called under the key lock.
+func checkObjectLock(r *http.Request, bucketName string, objectKey string, path string) ErrorCode {
+	fstat, err := os.Stat(path)
+	if err != nil || fstat.IsDir() {
+		return ErrNone
+	}
+
+	meta := loadObjectMeta(bucketName, objectKey, fstat)
+	if meta == nil {
+		return ErrNone
+	}
+
+	code := meta.lockError(canBypassGovernance(r, bucketName, objectKey))
+	if code != ErrNone {
+		log.Printf("Refusing to overwrite locked object %s/%s", bucketName, objectKey)
+	}
+	return code
+}
+
+// setObjectLockHeaders adds x-amz-object-lock-* headers to GetObject/HeadObject
+func setObjectLockHeaders(w http.ResponseWriter, meta *ObjectMeta) {
+	if meta == nil {
+		return
+	}
+	if meta.LockMode != "" && meta.LockRetainUntil != nil {
+		w.Header().Set("x-amz-object-lock-mode", meta.LockMode)
+		w.Header().Set("x-amz-object-lock-retain-until-date", meta.LockRetainUntil.Format(time.RFC3339))
+	}
+	if meta.LegalHold {
+		w.Header().Set("x-amz-object-lock-legal-hold", "ON")
+	}
+}
+
+// bucketHasLockedObjects reports whether any object of the bucket is under
+// retention or legal hold
+func bucketHasLockedObjects(bucketName string) bool {
+	locked := false
+	walkBucketObjects(bucketName, func(objectKey string, path string, info fs.FileInfo) {
+		if locked {
+			return
+		}
+		if meta := loadObjectMeta(bucketName, objectKey, info); meta != nil && meta.lockError(false) != ErrNone {
+			locked = true
+		}
+	})
+	return locked
+}
+
+// updateObjectLock applies update to the lock state of an existing object
+func updateObjectLock(bucketName string, objectKey string, filePath string, update func(meta *ObjectMeta) ErrorCode) ErrorCode {
+	unlock := objectLocks.Lock(bucketName, objectKey)
+	defer unlock()
+
+	fstat, err := os.Stat(objectFilePath(filePath))
+	if err != nil || fstat.IsDir() || isDirKey(objectKey) {
+		return ErrNoSuchKey
+	}
+
+	meta := loadObjectMeta(bucketName, objectKey, fstat)
+	if meta == nil {
+		meta = &ObjectMeta{}
+	}
+
+	if code := update(meta); code != ErrNone {
+		return code
+	}
+
+	if err = saveObjectMeta(bucketName, objectKey, meta, fstat); err != nil {
+		log.Printf("Error saving object lock of %s/%s : %s", bucketName, objectKey, err)
+		return ErrInternalError
+	}
+	return ErrNone
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObjectLockConfiguration.html
+func putObjectLockConfiguration(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var config XmlObjectLockConfiguration
+	if err = xml.Unmarshal(body, &config); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	if code := config.validate(); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	// object lock is enabled when the bucket is created
+	if bucketObjectLock(bucketName) == nil {
+		s3err(w, ErrInvalidBucketState)
+		return nil
+	}
+
+	err = updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.ObjectLock = &config
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving object lock configuration of %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectLockConfiguration.html
+func getObjectLockConfiguration(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	config := bucketObjectLock(bucketName)
+	if config == nil {
+		s3err(w, ErrObjectLockConfigurationNotFound)
+		return nil
+	}
+
+	config.Xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+	return writeXML(w, config)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObjectRetention.html
+func putObjectRetention(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	if bucketObjectLock(bucketName) == nil {
+		s3err(w, ErrInvalidRequest)
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var retention XmlObjectRetention
+	if err = xml.Unmarshal(body, &retention); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	// empty retention removes it
+	var until *time.Time
+	switch {
+	case retention.Mode == "" && retention.RetainUntilDate == "":
+	case retention.Mode != lockModeGovernance && retention.Mode != lockModeCompliance:
+		s3err(w, ErrMalformedXML)
+		return nil
+	default:
+		t, code := parseRetainUntil(retention.RetainUntilDate)
+		if code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+		until = &t
+	}
+
+	bypass := canBypassGovernance(r, bucketName, objectKey)
+
+	code := updateObjectLock(bucketName, objectKey, filePath, func(meta *ObjectMeta) ErrorCode {
+		if meta.retained() {
+			// retention may always be extended (and governance turned into
+			// compliance), anything else is only possible for governance
+			// retention with bypass
+			extends := until != nil && !until.Before(*meta.LockRetainUntil) &&
+				(retention.Mode == lockModeCompliance || meta.LockMode == lockModeGovernance)
+			if !extends && !(meta.LockMode == lockModeGovernance && bypass) {
+				return ErrAccessDenied
+			}
+		}
+		meta.LockMode, meta.LockRetainUntil = retention.Mode, until
+		return ErrNone
+	})
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	log.Printf("Retention of %s/%s set to %q until %v", bucketName, objectKey, retention.Mode, retention.RetainUntilDate)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectRetention.html
+func getObjectRetention(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	meta, code := objectLockMeta(bucketName, objectKey, filePath)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	if meta == nil || meta.LockMode == "" || meta.LockRetainUntil == nil {
+		s3err(w, ErrNoSuchObjectLockConfiguration)
+		return nil
+	}
+
+	return writeXML(w, XmlObjectRetention{
+		Xmlns:           "http://s3.amazonaws.com/doc/2006-03-01/",
+		Mode:            meta.LockMode,
+		RetainUntilDate: meta.LockRetainUntil.Format(time.RFC3339),
+	})
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObjectLegalHold.html
+func putObjectLegalHold(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	if bucketObjectLock(bucketName) == nil {
+		s3err(w, ErrInvalidRequest)
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var hold XmlObjectLegalHold
+	if err = xml.Unmarshal(body, &hold); err != nil || (hold.Status != "ON" && hold.Status != "OFF") {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	code := updateObjectLock(bucketName, objectKey, filePath, func(meta *ObjectMeta) ErrorCode {
+		meta.LegalHold = hold.Status == "ON"
+		return ErrNone
+	})
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	log.Printf("Legal hold of %s/%s set to %s", bucketName, objectKey, hold.Status)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectLegalHold.html
+func getObjectLegalHold(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	meta, code := objectLockMeta(bucketName, objectKey, filePath)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	if bucketObjectLock(bucketName) == nil {
+		s3err(w, ErrNoSuchObjectLockConfiguration)
+		return nil
+	}
+
+	response := XmlObjectLegalHold{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/", Status: "OFF"}
+	if meta != nil && meta.LegalHold {
+		response.Status = "ON"
+	}
+	return writeXML(w, response)
+}
+
+// objectLockMeta returns metadata of existing object (nil if it has none)
+func objectLockMeta(bucketName string, objectKey string, filePath string) (*ObjectMeta, ErrorCode) {
+	unlock := objectLocks.RLock(bucketName, objectKey)
+	defer unlock()
+
+	fstat, err := os.Stat(objectFilePath(filePath))
+	if err != nil || fstat.IsDir() || isDirKey(objectKey) {
+		return nil, ErrNoSuchKey
+	}
+	return loadObjectMeta(bucketName, objectKey, fstat), ErrNone
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Key "a/" must not reach the data of locked object "a" - in strict mode both
+// resolve to the same path
+func TestObjectLockDirKeyAlias(t *testing.T) {
+	testStorage(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/lkb", nil)
+	r.Header.Set("x-amz-bucket-object-lock-enabled", "true")
+	if handlePutRequest(w, r); w.Code != http.StatusOK {
+		t.Fatalf("CreateBucket : %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/lkb/a", strings.NewReader("held"))
+	r.Header.Set("x-amz-object-lock-legal-hold", "ON")
+	if handlePutRequest(w, r); w.Code != http.StatusCreated {
+		t.Fatalf("PUT : %d %s", w.Code, w.Body)
+	}
+
+	if w := testRequest(http.MethodDelete, "/lkb/a", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE of object under legal hold : %d", w.Code)
+	}
+	for _, method := range []string{http.MethodDelete, http.MethodGet} {
+		if w := testRequest(method, "/lkb/a/", nil); w.Code == http.StatusOK {
+			t.Errorf("%s /lkb/a/ : %d %q", method, w.Code, w.Body)
+		}
+	}
+	if w := testRequest(http.MethodPut, "/lkb/a/?legal-hold", []byte(`<LegalHold><Status>OFF</Status></LegalHold>`)); w.Code != http.StatusNotFound {
+		t.Errorf("PUT /lkb/a/?legal-hold : %d %s", w.Code, w.Body)
+	}
+
+	if w := testRequest(http.MethodGet, "/lkb/a", nil); w.Code != http.StatusOK || w.Body.String() != "held" {
+		t.Errorf("object under legal hold is gone : %d %q", w.Code, w.Body)
+	}
+
+	// directory objects are still deleted by their own key
+	if w := testRequest(http.MethodPut, "/lkb/d/", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT /lkb/d/ : %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(http.MethodDelete, "/lkb/d/", nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /lkb/d/ : %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(bucketDir("lkb") + "/d"); !os.IsNotExist(err) {
+		t.Errorf("directory object d/ not deleted")
+	}
+}
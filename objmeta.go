@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ObjectPart describes where a part of a multipart object lives inside the
+// assembled file.
+type ObjectPart struct {
+	PartNumber int    `json:"partNumber"`
+	Offset     int64  `json:"offset"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+// ObjectMeta is the sidecar record kept for every object written through the
+// S3 API. Objects placed into dir_buckets by other means simply have no record.
+type ObjectMeta struct {
+	Key     string       `json:"key"`
+	Size    int64        `json:"size"`
+	ModTime int64        `json:"mtime"` // unix nanoseconds of the data file the record describes
+	ETag    string       `json:"etag"`
+	Parts   []ObjectPart `json:"parts,omitempty"`
+
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+	ChecksumType      string `json:"checksumType,omitempty"` // FULL_OBJECT or COMPOSITE
+	Checksum          string `json:"checksum,omitempty"`     // base64, "-<parts>" suffix for COMPOSITE
+
+	Tags map[string]string `json:"tags,omitempty"`
+	ObjectLockState
+
+	Encryption *ObjectEncryption `json:"encryption,omitempty"`
+
+	// record of the version being replaced, for the data file still being
+	// that version after a crash between writing the record and the rename
+	Previous *ObjectMeta `json:"previous,omitempty"`
+}
+
+// objectMetaPath returns location of the metadata record for bucket/key.
+// Keys are hashed so that records never collide with each other the way
+// "a" and "a/b" would in a plain directory tree.
+func objectMetaPath(bucketName string, objectKey string) string {
+	sum := sha256.Sum256([]byte(objectKey))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(metaPath, bucketName, "objects", name[:2], name+".json")
+}
+
+// loadObjectMeta returns metadata record for bucket/key or nil if there is none.
+// A record which does not match size/mtime of the data file is considered stale
+// (the file was changed behind our back - touched, rsynced, restored from
+// backup): what was derived from the content is dropped, while tags and
+// object lock stay, so that WORM protection doesn't vanish with an mtime.
+// Encrypted file of the same size keeps its data key too (decryption
+// authenticates the content).
+func loadObjectMeta(bucketName string, objectKey string, fstat os.FileInfo) *ObjectMeta {
+	data, err := os.ReadFile(objectMetaPath(bucketName, objectKey))
+	if err != nil {
+		return nil
+	}
+
+	var meta ObjectMeta
+	if err = json.Unmarshal(data, &meta); err != nil {
+		log.Printf("Ignoring corrupted metadata for %s/%s : %s\n", bucketName, objectKey, err)
+		return nil
+	}
+
+	if meta.Key != objectKey {
+		return nil
+	}
+
+	if fstat != nil && !meta.describes(fstat) {
+		if meta.Previous != nil && meta.Previous.describes(fstat) {
+			meta = *meta.Previous
+		} else {
+			stale := ObjectMeta{Key: meta.Key, Size: meta.Size, ModTime: meta.ModTime, Tags: meta.Tags, ObjectLockState: meta.ObjectLockState}
+			if meta.Encryption != nil && encryptedSize(meta.Encryption.Size) == fstat.Size() {
+				stale.Encryption = meta.Encryption
+			}
+			meta = stale
+		}
+	}
+	meta.Previous = nil
+
+	return &meta
+}
+
+// describes reports whether the record was saved for data file with fstat
+func (m *ObjectMeta) describes(fstat os.FileInfo) bool {
+	return fstat.Size() == m.Size && fstat.ModTime().UnixNano() == m.ModTime
+}
+
+// saveObjectMeta persists metadata record for bucket/key. Size and mtime are
+// taken from the data file so that later reads can detect stale records.
+func saveObjectMeta(bucketName string, objectKey string, meta *ObjectMeta, fstat os.FileInfo) error {
+	meta.Key = objectKey
+	meta.Size = fstat.Size()
+	meta.ModTime = fstat.ModTime().UnixNano()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(objectMetaPath(bucketName, objectKey), data)
+}
+
+// commitObject moves temp file of a new object version over filePath along
+// with its metadata record. The record is written first, from size and mtime
+// of the temp file (rename keeps them), and put back if the rename fails, so
+// whatever fails the previous version of the object stays intact. The new
+// record keeps the previous one in case the process dies before the rename.
+func commitObject(file *os.File, filePath string, bucketName string, objectKey string, meta *ObjectMeta) (os.FileInfo, error) {
+	fstat, err := file.Stat()
+	if err != nil {
+		discardTempFile(file)
+		return nil, err
+	}
+
+	recordPath := objectMetaPath(bucketName, objectKey)
+	previous, err := os.ReadFile(recordPath)
+	hadRecord := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		discardTempFile(file)
+		return nil, err
+	}
+
+	var previousMeta ObjectMeta
+	if hadRecord && json.Unmarshal(previous, &previousMeta) == nil && previousMeta.Key == objectKey {
+		previousMeta.Previous = nil
+		meta.Previous = &previousMeta
+	}
+
+	if err = saveObjectMeta(bucketName, objectKey, meta, fstat); err != nil {
+		discardTempFile(file)
+		return nil, fmt.Errorf("saving metadata : %w", err)
+	}
+
+	if err = commitTempFile(file, filePath); err != nil {
+		var restoreErr error
+		if hadRecord {
+			restoreErr = writeFileAtomic(recordPath, previous)
+		} else {
+			restoreErr = os.Remove(recordPath)
+		}
+		if restoreErr != nil {
+			log.Printf("Error restoring metadata for %s/%s : %s\n", bucketName, objectKey, restoreErr)
+		}
+		return nil, err
+	}
+
+	return fstat, nil
+}
+
+// removeObjectMeta drops metadata record for bucket/key (if any)
+func removeObjectMeta(bucketName string, objectKey string) {
+	err := os.Remove(objectMetaPath(bucketName, objectKey))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing metadata for %s/%s : %s\n", bucketName, objectKey, err)
+	}
+}
+
+// objectETag returns ETag from the metadata record or calculates MD5 of the
+// (open) data file if no fresh record exists
+func objectETag(file *os.File, meta *ObjectMeta) (string, error) {
+	if meta != nil && meta.ETag != "" {
+		return meta.ETag, nil
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// multipartETag calculates ETag of assembled multipart object the way S3 does:
+// md5 of concatenated binary md5 sums of parts followed by "-<number of parts>"
+func multipartETag(partSums [][]byte) string {
+	hash := md5.New()
+	for _, sum := range partSums {
+		hash.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hash.Sum(nil)), len(partSums))
+}
+
+// objectPart resolves partNumber into byte range (and checksum) of the object.
+// Objects which were not uploaded in parts consist of the single part #1.
+func objectPart(meta *ObjectMeta, size int64, partNumber int) (ObjectPart, bool) {
+	if meta == nil || len(meta.Parts) == 0 {
+		if partNumber != 1 {
+			return ObjectPart{}, false
+		}
+		part := ObjectPart{PartNumber: 1, Size: size}
+		if meta != nil {
+			part.ETag, part.Checksum = meta.ETag, meta.Checksum
+		}
+		return part, true
+	}
+
+	for _, part := range meta.Parts {
+		if part.PartNumber == partNumber {
+			return part, true
+		}
+	}
+
+	return ObjectPart{}, false
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// S3 limits on object keys, plus the usual limit on the length of a file name
+const (
+	maxKeyLength      = 1024
+	maxPathComponent  = 255
+	minBucketNameLen  = 3
+	maxBucketNameLen  = 63
+	maxLocalBucketLen = 255
+)
+
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+
+// isValidBucketName checks name of a new bucket against S3 naming rules
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html
+func isValidBucketName(name string) bool {
+	if len(name) < minBucketNameLen || len(name) > maxBucketNameLen {
+		return false
+	}
+
+	if !bucketNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return false
+	}
+
+	// must not be formatted as IP address
+	if net.ParseIP(name) != nil {
+		return false
+	}
+
+	for _, prefix := range []string{"xn--", "sthree-", "amzn-s3-demo-"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+
+	for _, suffix := range []string{"-s3alias", "--ol-s3", ".mrap", "--x-s3", "--table-s3"} {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSafeBucketName is a relaxed check for existing buckets - directories
+// created in dir_buckets by other means do not have to follow S3 naming
+// rules, but the name must still be a single path component.
+func isSafeBucketName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > maxLocalBucketLen {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\\x00")
+}
+
+// bucketDir returns local directory of the bucket
+func bucketDir(bucketName string) string {
+	return filepath.Join(bucketPath, bucketName)
+}
+
+// resolveObjectPath maps object key onto local path inside the bucket
+// directory. Keys which can not be stored safely are rejected (strict mode) or
+// encoded (see keyenc.go) - every path returned is guaranteed to be within
+// bucket directory.
+func resolveObjectPath(bucketName string, objectKey string) (string, ErrorCode) {
+	return resolveKeyPath(bucketName, objectKey, false)
+}
+
+// resolvePrefixPath maps listing prefix onto local directory (trailing slash
+// denotes directory rather than an object)
+func resolvePrefixPath(bucketName string, prefix string) (string, ErrorCode) {
+	return resolveKeyPath(bucketName, prefix, true)
+}
+
+func resolveKeyPath(bucketName string, objectKey string, isPrefix bool) (string, ErrorCode) {
+	if !isSafeBucketName(bucketName) {
+		return "", ErrInvalidBucketName
+	}
+
+	root := bucketDir(bucketName)
+	if objectKey == "" {
+		return root, ErrNone
+	}
+
+	if len(objectKey) > maxKeyLength {
+		return "", ErrKeyTooLong
+	}
+
+	if !utf8.ValidString(objectKey) || strings.IndexByte(objectKey, 0) >= 0 {
+		return "", ErrInvalidObjectName
+	}
+
+	// trailing slash denotes directory (prefix), any other empty segment needs encoding
+	segments := strings.Split(objectKey, "/")
+	trailingSlash := len(segments) > 1 && segments[len(segments)-1] == ""
+	if trailingSlash {
+		segments = segments[:len(segments)-1]
+	}
+
+	names := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		if segmentNeedsEncoding(segment) {
+			if keyEncoding != keyEncodingEncode {
+				if len(segment) > maxPathComponent {
+					return "", ErrKeyTooLong
+				}
+				return "", ErrInvalidObjectName
+			}
+			segment = encodeSegment(bucketName, segment)
+		}
+		names = append(names, segment)
+	}
+
+	if trailingSlash && !isPrefix && keyEncoding == keyEncodingEncode {
+		names = append(names, slashObjectName)
+	}
+
+	path := filepath.Join(root, filepath.Join(names...))
+	if !isWithinDir(root, path) || path == root {
+		return "", ErrInvalidObjectName
+	}
+
+	return path, ErrNone
+}
+
+// isWithinDir reports whether path is dir itself or lies underneath it
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// walkBucketObjects calls fn for every object stored in the bucket (in
+// directory order). Temp files and parts of uploads in progress are skipped.
+func walkBucketObjects(bucketName string, fn func(objectKey string, path string, info fs.FileInfo)) error {
+	return walkObjectsDir(bucketName, bucketDir(bucketName), "", fn)
+}
+
+func walkObjectsDir(bucketName string, dir string, dirKey string, fn func(objectKey string, path string, info fs.FileInfo)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if isTempFile(name) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		if !entry.IsDir() && dirKey != "" {
+			switch name {
+			case selfObjectName:
+				fn(strings.TrimSuffix(dirKey, "/"), path, info)
+				continue
+			case slashObjectName:
+				fn(dirKey, path, info)
+				continue
+			}
+		}
+
+		segment, ok := decodeSegment(bucketName, name)
+		if !ok {
+			continue
+		}
+
+		if entry.IsDir() {
+			if err = walkObjectsDir(bucketName, path, dirKey+segment+"/", fn); err != nil {
+				log.Printf("Error walking %s : %s\n", path, err)
+			}
+		} else if !isUploadPart(name) {
+			fn(dirKey+segment, path, info)
+		}
+	}
+
+	return nil
+}
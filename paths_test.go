@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// No key, in either key encoding mode, may resolve to a path outside its
+// bucket directory.
+func FuzzResolveKeyPath(f *testing.F) {
+	dir := f.TempDir()
+	bucketPath, metaPath = filepath.Join(dir, "buckets"), filepath.Join(dir, "meta")
+
+	for _, bucket := range []string{"bkt", "..", ".", "", "a/b", "a\\b", "b\x00"} {
+		for _, key := range []string{
+			"x", "..", "../x", "a/../../x", "a/..", "./..", "%2e%2e/", "%2e%2e%2fx", "/abs", "//", "a//b/",
+			"..\\x", "a\\..\\..\\x", "x\x00y", "\x00", ".gos3rve-obj", strings.Repeat("a", 300) + "/..",
+		} {
+			f.Add(bucket, key, false, false)
+			f.Add(bucket, key, true, true)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, bucketName string, objectKey string, isPrefix bool, encode bool) {
+		keyEncoding = keyEncodingStrict
+		if encode {
+			keyEncoding = keyEncodingEncode
+		}
+
+		path, code := resolveKeyPath(bucketName, objectKey, isPrefix)
+		if code != ErrNone {
+			return
+		}
+
+		root := bucketDir(bucketName)
+		if !isWithinDir(root, path) {
+			t.Fatalf("bucket %q key %q resolved to %s outside of %s", bucketName, objectKey, path, root)
+		}
+
+		// the same without isWithinDir: path is the bucket dir or below it,
+		// which is a single component below bucketPath
+		if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			t.Fatalf("bucket %q key %q resolved to %s outside of %s", bucketName, objectKey, path, root)
+		}
+		if filepath.Dir(root) != filepath.Clean(bucketPath) || strings.ContainsRune(path, 0) {
+			t.Fatalf("bucket %q resolved to %s outside of %s", bucketName, root, bucketPath)
+		}
+		for _, name := range strings.Split(path[len(root):], string(filepath.Separator)) {
+			if name == ".." || name == "." {
+				t.Fatalf("bucket %q key %q resolved to %s with %q", bucketName, objectKey, path, name)
+			}
+		}
+	})
+}
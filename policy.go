@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// IAM-style policies attached to users (<PolicyFile> of a <User> in config).
+// Users without a policy, and admins, may do anything. Otherwise a request
+// has to be allowed by some statement and not denied by any.
+//
+// Supported condition operators are String(Not)Equals, String(Not)Like and
+// StringEqualsIgnoreCase with optional ForAnyValue:/ForAllValues: prefixes and
+// IfExists suffix. Condition keys:
+//
+//	s3:ExistingObjectTag/<key>   tag of the object the request operates on
+//	s3:RequestObjectTag/<key>    tag sent in x-amz-tagging header
+//	s3:RequestObjectTagKeys      keys of tags sent in x-amz-tagging header
+//	s3:prefix                    prefix of ListObjects request
+type PolicyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+type PolicyStatement struct {
+	Sid       string                              `json:"Sid,omitempty"`
+	Effect    string                              `json:"Effect"`
+	Action    policyStrings                       `json:"Action"`
+	Resource  policyStrings                       `json:"Resource"`
+	Condition map[string]map[string]policyStrings `json:"Condition,omitempty"`
+}
+
+// policyStrings is a JSON string or list of strings
+type policyStrings []string
+
+func (p *policyStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*p = policyStrings{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+var policyOperators = map[string]bool{
+	"StringEquals":           true,
+	"StringNotEquals":        true,
+	"StringEqualsIgnoreCase": true,
+	"StringLike":             true,
+	"StringNotLike":          true,
+}
+
+// loadPolicyFile reads and validates policy document
+func loadPolicyFile(policyPath string) (*PolicyDocument, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy PolicyDocument
+	if err = json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+
+	if len(policy.Statement) == 0 {
+		return nil, fmt.Errorf("no statements")
+	}
+
+	for i, statement := range policy.Statement {
+		if statement.Effect != "Allow" && statement.Effect != "Deny" {
+			return nil, fmt.Errorf("statement %d: invalid Effect \"%s\"", i, statement.Effect)
+		}
+		if len(statement.Action) == 0 || len(statement.Resource) == 0 {
+			return nil, fmt.Errorf("statement %d: Action and Resource are required", i)
+		}
+		for operator := range statement.Condition {
+			if _, _, _, ok := parsePolicyOperator(operator); !ok {
+				return nil, fmt.Errorf("statement %d: unsupported condition operator \"%s\"", i, operator)
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// parsePolicyOperator splits "ForAnyValue:StringLikeIfExists" into its parts
+func parsePolicyOperator(operator string) (name string, qualifier string, ifExists bool, ok bool) {
+	if q, rest, found := strings.Cut(operator, ":"); found {
+		if q != "ForAnyValue" && q != "ForAllValues" {
+			return "", "", false, false
+		}
+		qualifier, operator = q, rest
+	}
+
+	name, ifExists = strings.CutSuffix(operator, "IfExists")
+	return name, qualifier, ifExists, policyOperators[name]
+}
+
+// policyRequest is the request as seen by policy evaluation
+type policyRequest struct {
+	action   string
+	resource string
+	values   func(key string) ([]string, bool)
+}
+
+// policyMatch compares value with pattern using * and ? wildcards
+func policyMatch(pattern string, value string, ignoreCase bool) bool {
+	if ignoreCase {
+		pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	}
+	// path.Match treats "/" specially, policy wildcards don't
+	pattern = strings.ReplaceAll(pattern, "/", "\x00")
+	value = strings.ReplaceAll(value, "/", "\x00")
+	pattern = strings.NewReplacer("[", "\\[", "]", "\\]").Replace(pattern)
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+func policyMatchAny(patterns []string, value string, ignoreCase bool) bool {
+	for _, pattern := range patterns {
+		if policyMatch(pattern, value, ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
+
+func evaluateCondition(operator string, expected []string, values []string, exists bool) bool {
+	name, qualifier, ifExists, _ := parsePolicyOperator(operator)
+	negated := strings.Contains(name, "Not")
+
+	// ForAllValues holds for the empty set of a missing key
+	if !exists {
+		return ifExists || negated || qualifier == "ForAllValues"
+	}
+
+	match := func(value string) bool {
+		switch name {
+		case "StringEquals", "StringNotEquals":
+			return contains(expected, value)
+		case "StringEqualsIgnoreCase":
+			for _, e := range expected {
+				if strings.EqualFold(e, value) {
+					return true
+				}
+			}
+			return false
+		default:
+			return policyMatchAny(expected, value, false)
+		}
+	}
+
+	result := qualifier == "ForAllValues"
+	for _, value := range values {
+		m := match(value)
+		if qualifier == "ForAllValues" {
+			result = result && m
+		} else if m {
+			result = true
+			break
+		}
+	}
+
+	if negated {
+		return !result
+	}
+	return result
+}
+
+func (s *PolicyStatement) matches(req *policyRequest) bool {
+	if !policyMatchAny(s.Action, req.action, true) || !policyMatchAny(s.Resource, req.resource, false) {
+		return false
+	}
+
+	for operator, conditions := range s.Condition {
+		for key, expected := range conditions {
+			values, exists := req.values(key)
+			if !evaluateCondition(operator, expected, values, exists) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// allows reports whether the policy allows the request (explicit deny wins)
+func (p *PolicyDocument) allows(req *policyRequest) bool {
+	allowed := false
+	for i := range p.Statement {
+		statement := &p.Statement[i]
+		if !statement.matches(req) {
+			continue
+		}
+		if statement.Effect == "Deny" {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// isRequestAllowed checks the policy of the requester for action on bucket/key
+func isRequestAllowed(r *http.Request, action string, bucketName string, objectKey string) bool {
+	id := requestIdentity(r)
+	if id == nil || id.Admin || id.Policy == nil {
+		return true
+	}
+
+	resource := "arn:aws:s3:::" + bucketName
+	if objectKey != "" {
+		resource += "/" + objectKey
+	}
+
+	var existingTags map[string]string
+	existingLoaded := false
+
+	requestTags, _ := parseTaggingHeader(r)
+
+	values := func(key string) ([]string, bool) {
+		switch {
+		case strings.HasPrefix(key, "s3:ExistingObjectTag/"):
+			if !existingLoaded {
+				existingLoaded = true
+				if filePath, code := resolveObjectPath(bucketName, objectKey); code == ErrNone && objectKey != "" {
+					existingTags = objectTags(bucketName, objectKey, filePath)
+				}
+			}
+			value, ok := existingTags[strings.TrimPrefix(key, "s3:ExistingObjectTag/")]
+			return []string{value}, ok
+		case strings.HasPrefix(key, "s3:RequestObjectTag/"):
+			value, ok := requestTags[strings.TrimPrefix(key, "s3:RequestObjectTag/")]
+			return []string{value}, ok
+		case key == "s3:RequestObjectTagKeys":
+			keys := make([]string, 0, len(requestTags))
+			for k := range requestTags {
+				keys = append(keys, k)
+			}
+			return keys, len(keys) > 0
+		case key == "s3:prefix":
+			prefix, ok := requestPrefix(r)
+			return []string{prefix}, ok
+		}
+		return nil, false
+	}
+
+	return id.Policy.allows(&policyRequest{action: action, resource: resource, values: values})
+}
+
+// authorizeRequest checks the request against the policy of its signer. Bucket
+// and key are resolved by extractBucketAndKey like handlers do, so the policy
+// sees the object the request operates on.
+func authorizeRequest(r *http.Request) bool {
+	bucketName, objectKey, _ := extractBucketAndKey(r)
+	if isListRequest(r) {
+		objectKey = "" // the prefix, s3:ListBucket applies to the bucket
+	}
+	return isRequestAllowed(r, requestAction(r, bucketName, objectKey), bucketName, objectKey)
+}
+
+// isListRequest reports whether request lists the bucket with no key in its
+// path, so extractBucketAndKey takes the key from prefix of the query
+func isListRequest(r *http.Request) bool {
+	_, pathKey, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return pathKey == "" && isListMethod(r)
+}
+
+// requestPrefix returns prefix of ListObjects request as handlers resolve it
+func requestPrefix(r *http.Request) (string, bool) {
+	if !isListRequest(r) || !r.URL.Query().Has("prefix") {
+		return "", false
+	}
+	_, prefix, _ := extractBucketAndKey(r)
+	return prefix, true
+}
+
+// requestAction returns IAM action name of the S3 request
+// https://docs.aws.amazon.com/service-authorization/latest/reference/list_amazons3.html
+func requestAction(r *http.Request, bucketName string, objectKey string) string {
+	query := r.URL.Query()
+
+	if bucketName == "" {
+		return "s3:ListAllMyBuckets"
+	}
+
+	if objectKey == "" {
+		for _, sub := range []struct{ name, get, put, del string }{
+			{"location", "s3:GetBucketLocation", "", ""},
+			{"cors", "s3:GetBucketCORS", "s3:PutBucketCORS", "s3:PutBucketCORS"},
+			{"lifecycle", "s3:GetLifecycleConfiguration", "s3:PutLifecycleConfiguration", "s3:PutLifecycleConfiguration"},
+			{"tagging", "s3:GetBucketTagging", "s3:PutBucketTagging", "s3:PutBucketTagging"},
+			{"encryption", "s3:GetEncryptionConfiguration", "s3:PutEncryptionConfiguration", "s3:PutEncryptionConfiguration"},
+			{"object-lock", "s3:GetBucketObjectLockConfiguration", "s3:PutBucketObjectLockConfiguration", "s3:PutBucketObjectLockConfiguration"},
+			{"logging", "s3:GetBucketLogging", "s3:PutBucketLogging", ""},
+		} {
+			if !query.Has(sub.name) {
+				continue
+			}
+			switch r.Method {
+			case http.MethodGet:
+				return sub.get
+			case http.MethodPut:
+				return sub.put
+			case http.MethodDelete:
+				return sub.del
+			}
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			return "s3:CreateBucket"
+		case http.MethodDelete:
+			return "s3:DeleteBucket"
+		}
+		return "s3:ListBucket"
+	}
+
+	if query.Has("retention") {
+		if r.Method == http.MethodPut {
+			return "s3:PutObjectRetention"
+		}
+		return "s3:GetObjectRetention"
+	}
+
+	if query.Has("legal-hold") {
+		if r.Method == http.MethodPut {
+			return "s3:PutObjectLegalHold"
+		}
+		return "s3:GetObjectLegalHold"
+	}
+
+	if query.Has("tagging") {
+		switch r.Method {
+		case http.MethodPut:
+			return "s3:PutObjectTagging"
+		case http.MethodDelete:
+			return "s3:DeleteObjectTagging"
+		}
+		return "s3:GetObjectTagging"
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if query.Has("attributes") {
+			return "s3:GetObjectAttributes"
+		}
+		return "s3:GetObject"
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return "s3:AbortMultipartUpload"
+		}
+		return "s3:DeleteObject"
+	}
+
+	return "s3:PutObject"
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPolicy(t *testing.T, document string) *PolicyDocument {
+	t.Helper()
+	var policy PolicyDocument
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		t.Fatal(err)
+	}
+	return &policy
+}
+
+// Deny has to apply to the key handlers operate on, however it is encoded
+func TestAuthorizeRequestEncodedKey(t *testing.T) {
+	id := &s3Identity{AccessKeyId: "ci", Policy: testPolicy(t, `{
+		"Statement": [
+			{"Effect": "Allow", "Action": "s3:*", "Resource": ["arn:aws:s3:::b", "arn:aws:s3:::b/*"]},
+			{"Effect": "Deny", "Action": "s3:*", "Resource": ["arn:aws:s3:::b/secret/*", "arn:aws:s3:::b/a b"]},
+			{"Effect": "Deny", "Action": "s3:ListBucket", "Resource": "arn:aws:s3:::b",
+			 "Condition": {"StringLike": {"s3:prefix": "secret/*"}}}
+		]}`)}
+
+	for _, test := range []struct {
+		method string
+		target string
+		allow  bool
+	}{
+		{"GET", "/b/public/x", true},
+		{"GET", "/b/secret/x", false},
+		{"GET", "/b/secret%2Fx", false},
+		{"GET", "/b/secret%252Fx", false},
+		{"PUT", "/b/secret%252Fx", false},
+		{"DELETE", "/b/secret%252Fx", false},
+		{"GET", "/b/a+b", false},
+		{"GET", "/b?prefix=public/", true},
+		{"GET", "/b?prefix=secret/", false},
+		{"GET", "/b?prefix=secret%7C&delimiter=%7C", false},
+		{"PUT", "/b?prefix=secret/x", true},
+		{"DELETE", "/b?prefix=secret/x", true},
+	} {
+		r := withIdentity(httptest.NewRequest(test.method, test.target, nil), id)
+		bucketName, objectKey, _ := extractBucketAndKey(r)
+		if allowed := authorizeRequest(r); allowed != test.allow {
+			t.Errorf("%s %s (bucket %q key %q) : allowed %v, expected %v", test.method, test.target, bucketName, objectKey, allowed, test.allow)
+		}
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, value string
+		ignoreCase     bool
+		match          bool
+	}{
+		{"s3:*", "s3:GetObject", false, true},
+		{"s3:get*", "s3:GetObject", true, true},
+		{"s3:get*", "s3:GetObject", false, false},
+		{"s3:?etObject", "s3:GetObject", false, true},
+		{"arn:aws:s3:::b/*", "arn:aws:s3:::b/a/b/c", false, true},
+		{"arn:aws:s3:::b/*/c", "arn:aws:s3:::b/a/b/c", false, true},
+		{"arn:aws:s3:::b/*", "arn:aws:s3:::b", false, false},
+		{"arn:aws:s3:::b", "arn:aws:s3:::bb", false, false},
+		{"arn:aws:s3:::b/[a]", "arn:aws:s3:::b/a", false, false},
+		{"arn:aws:s3:::b/[a]", "arn:aws:s3:::b/[a]", false, true},
+	} {
+		if match := policyMatch(test.pattern, test.value, test.ignoreCase); match != test.match {
+			t.Errorf("policyMatch(%q, %q, %v) = %v", test.pattern, test.value, test.ignoreCase, match)
+		}
+	}
+}
+
+func TestPolicyConditions(t *testing.T) {
+	for _, test := range []struct {
+		operator string
+		expected []string
+		values   []string
+		exists   bool
+		result   bool
+	}{
+		{"StringEquals", []string{"ci"}, []string{"ci"}, true, true},
+		{"StringEquals", []string{"ci"}, []string{"CI"}, true, false},
+		{"StringEquals", []string{"ci"}, nil, false, false},
+		{"StringEqualsIfExists", []string{"ci"}, nil, false, true},
+		{"StringNotEquals", []string{"ci"}, []string{"qa"}, true, true},
+		{"StringNotEquals", []string{"ci"}, []string{"ci"}, true, false},
+		{"StringNotEquals", []string{"ci"}, nil, false, true},
+		{"StringEqualsIgnoreCase", []string{"ci"}, []string{"CI"}, true, true},
+		{"StringLike", []string{"release-*"}, []string{"release-1.2"}, true, true},
+		{"StringNotLike", []string{"release-*"}, []string{"main"}, true, true},
+		{"ForAnyValue:StringEquals", []string{"team"}, []string{"branch", "team"}, true, true},
+		{"ForAllValues:StringEquals", []string{"team", "branch"}, []string{"branch", "team"}, true, true},
+		{"ForAllValues:StringEquals", []string{"team"}, []string{"branch", "team"}, true, false},
+		{"ForAllValues:StringEquals", []string{"team"}, nil, false, true},
+		{"ForAnyValue:StringEquals", []string{"team"}, nil, false, false},
+	} {
+		if result := evaluateCondition(test.operator, test.expected, test.values, test.exists); result != test.result {
+			t.Errorf("%s %q on %q (exists %v) = %v", test.operator, test.expected, test.values, test.exists, result)
+		}
+	}
+}
+
+// explicit Deny wins over any Allow, no matching statement denies
+func TestPolicyDenyPrecedence(t *testing.T) {
+	policy := testPolicy(t, `{"Statement": [
+		{"Effect": "Allow", "Action": "s3:*", "Resource": "arn:aws:s3:::b/*"},
+		{"Effect": "Deny", "Action": "s3:DeleteObject", "Resource": "arn:aws:s3:::b/keep/*"},
+		{"Effect": "Allow", "Action": "s3:DeleteObject", "Resource": "arn:aws:s3:::b/keep/x"}
+	]}`)
+	noValues := func(string) ([]string, bool) { return nil, false }
+
+	for _, test := range []struct {
+		action, resource string
+		allow            bool
+	}{
+		{"s3:GetObject", "arn:aws:s3:::b/keep/x", true},
+		{"s3:DeleteObject", "arn:aws:s3:::b/tmp/x", true},
+		{"s3:DeleteObject", "arn:aws:s3:::b/keep/x", false},
+		{"s3:GetObject", "arn:aws:s3:::other/x", false},
+		{"s3:ListBucket", "arn:aws:s3:::b", false},
+	} {
+		if allowed := policy.allows(&policyRequest{action: test.action, resource: test.resource, values: noValues}); allowed != test.allow {
+			t.Errorf("%s on %s : allowed %v, expected %v", test.action, test.resource, allowed, test.allow)
+		}
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	valid := filepath.Join(t.TempDir(), "policy.json")
+	document := `{"Statement": [{"Effect": "Allow", "Action": "s3:*", "Resource": "*", "Condition": {"ForAnyValue:StringLikeIfExists": {"s3:prefix": "a*"}}}]}`
+	if err := os.WriteFile(valid, []byte(document), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPolicyFile(valid); err != nil {
+		t.Fatalf("valid policy rejected: %v", err)
+	}
+
+	for name, document := range map[string]string{
+		"no statements": `{"Statement": []}`,
+		"effect":        `{"Statement": [{"Effect": "Maybe", "Action": "s3:*", "Resource": "*"}]}`,
+		"resource":      `{"Statement": [{"Effect": "Allow", "Action": "s3:*"}]}`,
+		"operator":      `{"Statement": [{"Effect": "Allow", "Action": "s3:*", "Resource": "*", "Condition": {"NumericLessThan": {"s3:max-keys": "10"}}}]}`,
+		"qualifier":     `{"Statement": [{"Effect": "Allow", "Action": "s3:*", "Resource": "*", "Condition": {"ForSome:StringEquals": {"s3:prefix": "a"}}}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(path, []byte(document), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPolicyFile(path); err == nil {
+			t.Errorf("invalid policy (%s) accepted", name)
+		}
+	}
+}
+
+// s3:ExistingObjectTag reads tags stored with the object, s3:RequestObjectTag
+// those sent in x-amz-tagging
+func TestPolicyTagConditions(t *testing.T) {
+	testStorage(t)
+	for key, tagging := range map[string]string{"ci-build": "team=ci", "qa-build": "team=qa"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/bkt/"+key, strings.NewReader(key))
+		r.Header.Set("x-amz-tagging", tagging)
+		if handlePutRequest(w, r); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s : %d %s", key, w.Code, w.Body)
+		}
+	}
+
+	id := &s3Identity{AccessKeyId: "ci", Policy: testPolicy(t, `{"Statement": [
+		{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bkt/*",
+		 "Condition": {"StringEquals": {"s3:ExistingObjectTag/team": "ci"}}},
+		{"Effect": "Allow", "Action": "s3:PutObject", "Resource": "arn:aws:s3:::bkt/*",
+		 "Condition": {"StringEquals": {"s3:RequestObjectTag/team": "ci"}}}
+	]}`)}
+
+	for _, test := range []struct {
+		method, target, tagging string
+		allow                   bool
+	}{
+		{"GET", "/bkt/ci-build", "", true},
+		{"GET", "/bkt/qa-build", "", false},
+		{"GET", "/bkt/missing", "", false},
+		{"PUT", "/bkt/new", "team=ci", true},
+		{"PUT", "/bkt/new", "team=qa", false},
+		{"PUT", "/bkt/new", "", false},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.tagging != "" {
+			r.Header.Set("x-amz-tagging", test.tagging)
+		}
+		if allowed := authorizeRequest(withIdentity(r, id)); allowed != test.allow {
+			t.Errorf("%s %s (tags %q) : allowed %v, expected %v", test.method, test.target, test.tagging, allowed, test.allow)
+		}
+	}
+}
+
+// PUT and DELETE on the bucket are authorized as bucket actions, a prefix in
+// their query must not turn them into object writes
+func TestBucketRequestIgnoresPrefix(t *testing.T) {
+	testStorage(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	if w := testRequest(http.MethodPut, "/bkt?prefix=secret/x", []byte("data")); w.Code == http.StatusCreated || w.Code == http.StatusOK {
+		t.Errorf("PUT /bkt?prefix=secret/x : %d", w.Code)
+	}
+	if w := testRequest(http.MethodGet, "/bkt/secret/x", nil); w.Code != http.StatusNotFound {
+		t.Errorf("PUT /bkt?prefix=secret/x stored an object")
+	}
+
+	if w := testRequest(http.MethodPut, "/bkt/secret/x", []byte("data")); w.Code != http.StatusCreated {
+		t.Fatalf("PUT : %d %s", w.Code, w.Body)
+	}
+	testRequest(http.MethodDelete, "/bkt?prefix=secret/x", nil)
+	if w := testRequest(http.MethodGet, "/bkt/secret/x", nil); w.Code != http.StatusOK {
+		t.Errorf("DELETE /bkt?prefix=secret/x deleted the object : %d", w.Code)
+	}
+}
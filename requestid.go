@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestWriter wraps ResponseWriter of every S3 request. It carries the
+// request (for error responses) and its IDs, which are returned in
+// x-amz-request-id/x-amz-id-2 headers so that client errors can be matched
+// with server logs. It also records what access logs need to know about the
+// response.
+type requestWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	requestID string
+	hostID    string
+
+	start     time.Time
+	requester string // access key the request was signed with
+	status    int
+	errorCode string
+	bytesSent int64
+	firstByte time.Time
+	body      *countingBody
+	throttle  []*tokenBucket // download bandwidth limits
+}
+
+// countingBody counts bytes of request body read by handlers
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	done time.Time // when the body has been read completely
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF && b.done.IsZero() {
+		b.done = time.Now()
+	}
+	return n, err
+}
+
+func newRequestWriter(w http.ResponseWriter, r *http.Request) *requestWriter {
+	id := make([]byte, 8)
+	host := make([]byte, 24)
+	rand.Read(id)
+	rand.Read(host)
+
+	rw := &requestWriter{
+		ResponseWriter: w,
+		r:              r,
+		requestID:      strings.ToUpper(hex.EncodeToString(id)),
+		hostID:         base64.StdEncoding.EncodeToString(host),
+		start:          time.Now(),
+	}
+	if r.Body != nil {
+		rw.body = &countingBody{ReadCloser: r.Body}
+		r.Body = rw.body
+	}
+
+	w.Header().Set("x-amz-request-id", rw.requestID)
+	w.Header().Set("x-amz-id-2", rw.hostID)
+	return rw
+}
+
+func (w *requestWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.firstByte = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytesSent += int64(n)
+	if n > 0 && len(w.throttle) > 0 {
+		throttle(w.r.Context(), w.throttle, n)
+	}
+	return n, err
+}
+
+func (w *requestWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bytesReceived returns size of request body read so far
+func (w *requestWriter) bytesReceived() int64 {
+	if w.body == nil {
+		return 0
+	}
+	return w.body.n
+}
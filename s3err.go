@@ -4,10 +4,10 @@ package main
 //consulted & copied error codes - big thank you!
 
 import (
-	"bytes"
 	"encoding/xml"
-	"fmt"
+	"log"
 	"net/http"
+	"strings"
 )
 
 // APIError structure
@@ -46,16 +46,24 @@ const (
 	ErrNoSuchBucketPolicy
 	ErrNoSuchCORSConfiguration
 	ErrNoSuchLifecycleConfiguration
+	ErrNoSuchTagSet
+	ErrNoSuchEncryptionConfiguration
+	ErrInvalidTargetBucketForLogging
+	ErrObjectLockConfigurationNotFound
+	ErrNoSuchObjectLockConfiguration
+	ErrInvalidBucketState
 	ErrNoSuchKey
 	ErrNoSuchUpload
 	ErrInvalidBucketName
 	ErrInvalidDigest
+	ErrBadDigest
 	ErrInvalidMaxKeys
 	ErrInvalidMaxUploads
 	ErrInvalidMaxParts
 	ErrInvalidMaxDeleteObjects
 	ErrInvalidPartNumberMarker
 	ErrInvalidPart
+	ErrInvalidPartNumber
 	ErrInvalidRange
 	ErrInternalError
 	ErrInvalidCopyDest
@@ -90,9 +98,21 @@ const (
 	ErrRequestNotReadyYet
 	ErrMissingDateHeader
 	ErrInvalidRequest
+	ErrInvalidArgument
+	ErrKeyTooLong
+	ErrInvalidObjectName
+	ErrInvalidLocationConstraint
+	ErrIllegalLocationConstraint
+	ErrCORSForbidden
 	ErrAuthNotSetup
 	ErrNotImplemented
 	ErrPreconditionFailed
+	ErrInvalidEncryptionAlgorithm
+	ErrSSECustomerKeyInvalid
+	ErrSSECustomerKeyMissing
+	ErrSSECustomerKeyMismatch
+	ErrSSECustomerNotApplicable
+	ErrInsecureSSECustomerRequest
 
 	ErrExistingObjectIsDirectory
 	ErrExistingObjectIsFile
@@ -126,21 +146,42 @@ const (
 
 func s3err(w http.ResponseWriter, code ErrorCode) (err error) {
 
-	var buffer bytes.Buffer
-
 	apiErr := GetAPIError(code)
 
-	buffer.WriteString(fmt.Sprintf(
-		`<?xml version='1.0' encoding='UTF-8'?>
-		<Error>
-			<Code>%s</Code>
-			<Message>%s</Message>
-			<RequestId>4442587FB7D0A2F9</RequestId>
-		</Error>
-	
-`, apiErr.Code, apiErr.Description))
-
-	http.Error(w, buffer.String(), apiErr.HTTPStatusCode)
+	response := RESTErrorResponse{
+		Code:       apiErr.Code,
+		Message:    apiErr.Description,
+		StatusCode: apiErr.HTTPStatusCode,
+	}
+
+	// details of the request being answered
+	isHead := false
+	if rw, ok := w.(*requestWriter); ok {
+		response.RequestID = rw.requestID
+		response.Resource = rw.r.URL.Path
+		bucketName, objectKey, _ := strings.Cut(strings.TrimPrefix(rw.r.URL.Path, "/"), "/")
+		response.BucketName, response.Key = bucketName, objectKey
+		isHead = rw.r.Method == http.MethodHead
+		rw.errorCode = apiErr.Code
+		log.Printf("%s %s : %s (request id %s)", rw.r.Method, rw.r.URL.Path, apiErr.Code, rw.requestID)
+	}
+
+	body, err := xml.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(response.StatusCode)
+
+	// responses to HEAD requests have no body
+	if isHead {
+		return nil
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(body)
 
 	return nil
 }
@@ -183,6 +224,11 @@ var errorCodeResponse = map[ErrorCode]APIError{
 		Description:    "The Content-Md5 you specified is not valid.",
 		HTTPStatusCode: http.StatusBadRequest,
 	},
+	ErrBadDigest: {
+		Code:           "BadDigest",
+		Description:    "The checksum you specified did not match the calculated checksum.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
 	ErrInvalidMaxUploads: {
 		Code:           "InvalidArgument",
 		Description:    "Argument max-uploads must be an integer between 0 and 2147483647",
@@ -223,6 +269,36 @@ var errorCodeResponse = map[ErrorCode]APIError{
 		Description:    "The CORS configuration does not exist",
 		HTTPStatusCode: http.StatusNotFound,
 	},
+	ErrObjectLockConfigurationNotFound: {
+		Code:           "ObjectLockConfigurationNotFoundError",
+		Description:    "Object Lock configuration does not exist for this bucket",
+		HTTPStatusCode: http.StatusNotFound,
+	},
+	ErrNoSuchObjectLockConfiguration: {
+		Code:           "NoSuchObjectLockConfiguration",
+		Description:    "The specified object does not have a ObjectLock configuration",
+		HTTPStatusCode: http.StatusNotFound,
+	},
+	ErrInvalidBucketState: {
+		Code:           "InvalidBucketState",
+		Description:    "Object Lock configuration cannot be enabled on existing buckets",
+		HTTPStatusCode: http.StatusConflict,
+	},
+	ErrNoSuchEncryptionConfiguration: {
+		Code:           "ServerSideEncryptionConfigurationNotFoundError",
+		Description:    "The server side encryption configuration was not found",
+		HTTPStatusCode: http.StatusNotFound,
+	},
+	ErrInvalidTargetBucketForLogging: {
+		Code:           "InvalidTargetBucketForLogging",
+		Description:    "The target bucket for logging does not exist",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrNoSuchTagSet: {
+		Code:           "NoSuchTagSet",
+		Description:    "The TagSet does not exist",
+		HTTPStatusCode: http.StatusNotFound,
+	},
 	ErrNoSuchLifecycleConfiguration: {
 		Code:           "NoSuchLifecycleConfiguration",
 		Description:    "The lifecycle configuration does not exist",
@@ -250,6 +326,11 @@ var errorCodeResponse = map[ErrorCode]APIError{
 		HTTPStatusCode: http.StatusBadRequest,
 	},
 
+	ErrInvalidPartNumber: {
+		Code:           "InvalidPartNumber",
+		Description:    "The requested partnumber is not satisfiable",
+		HTTPStatusCode: http.StatusRequestedRangeNotSatisfiable,
+	},
 	ErrInvalidCopyDest: {
 		Code:           "InvalidRequest",
 		Description:    "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.",
@@ -410,11 +491,71 @@ var errorCodeResponse = map[ErrorCode]APIError{
 		Description:    "Invalid Request",
 		HTTPStatusCode: http.StatusBadRequest,
 	},
+	ErrInvalidArgument: {
+		Code:           "InvalidArgument",
+		Description:    "Invalid Argument",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrKeyTooLong: {
+		Code:           "KeyTooLongError",
+		Description:    "Your key is too long",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrInvalidObjectName: {
+		Code:           "InvalidObjectName",
+		Description:    "Object name contains unsupported characters or path segments.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrInvalidLocationConstraint: {
+		Code:           "InvalidLocationConstraint",
+		Description:    "The specified location constraint is not valid.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrIllegalLocationConstraint: {
+		Code:           "IllegalLocationConstraintException",
+		Description:    "The location constraint is incompatible for the region specific endpoint this request was sent to.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrCORSForbidden: {
+		Code:           "AccessForbidden",
+		Description:    "CORSResponse: This CORS request is not allowed.",
+		HTTPStatusCode: http.StatusForbidden,
+	},
 	ErrInvalidRange: {
 		Code:           "InvalidRange",
 		Description:    "The requested range is not satisfiable",
 		HTTPStatusCode: http.StatusRequestedRangeNotSatisfiable,
 	},
+	ErrInvalidEncryptionAlgorithm: {
+		Code:           "InvalidEncryptionAlgorithmError",
+		Description:    "The encryption request you specified is not valid. The valid value is AES256.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrSSECustomerKeyInvalid: {
+		Code:           "InvalidArgument",
+		Description:    "The secret key or its MD5 digest provided in the SSE-C headers is not valid.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrSSECustomerKeyMissing: {
+		Code:           "InvalidRequest",
+		Description:    "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrSSECustomerKeyMismatch: {
+		Code:           "AccessDenied",
+		Description:    "The provided SSE-C key does not match the key the object was encrypted with.",
+		HTTPStatusCode: http.StatusForbidden,
+	},
+	ErrSSECustomerNotApplicable: {
+		Code:           "InvalidRequest",
+		Description:    "The encryption parameters are not applicable to this object.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
+	ErrInsecureSSECustomerRequest: {
+		Code:           "InvalidRequest",
+		Description:    "Requests specifying Server Side Encryption with Customer provided keys must be made over a secure connection.",
+		HTTPStatusCode: http.StatusBadRequest,
+	},
 	ErrAuthNotSetup: {
 		Code:           "InvalidRequest",
 		Description:    "Signed request requires setting up SeaweedFS S3 authentication",
@@ -441,14 +582,14 @@ var errorCodeResponse = map[ErrorCode]APIError{
 		HTTPStatusCode: http.StatusConflict,
 	},
 	ErrTooManyRequest: {
-		Code:           "ErrTooManyRequest",
-		Description:    "Too many simultaneous request count",
-		HTTPStatusCode: http.StatusTooManyRequests,
+		Code:           "SlowDown",
+		Description:    "Please reduce your request rate.",
+		HTTPStatusCode: http.StatusServiceUnavailable,
 	},
 	ErrRequestBytesExceed: {
-		Code:           "ErrRequestBytesExceed",
-		Description:    "Simultaneous request bytes exceed limitations",
-		HTTPStatusCode: http.StatusTooManyRequests,
+		Code:           "SlowDown",
+		Description:    "Please reduce your request rate (bandwidth limit exceeded).",
+		HTTPStatusCode: http.StatusServiceUnavailable,
 	},
 
 	OwnershipControlsNotFoundError: {
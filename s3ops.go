@@ -7,33 +7,184 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_CreateBucket.html
+type XmlCreateBucketConfiguration struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string   `xml:"LocationConstraint"`
+}
+
+// region names like us-east-1 or us-gov-west-1
+var regionNamePattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
 func makeBucket(w http.ResponseWriter, r *http.Request, bucketName string) (err error) {
 
+	if !isValidBucketName(bucketName) {
+		s3err(w, ErrInvalidBucketName)
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	// bucket can only be created in the region we serve (us-east-1 is
+	// denoted by empty LocationConstraint)
+	region := s3region
+	if len(bytes.TrimSpace(body)) > 0 {
+		var config XmlCreateBucketConfiguration
+		if err = xml.Unmarshal(body, &config); err != nil {
+			s3err(w, ErrMalformedXML)
+			return nil
+		}
+		switch config.LocationConstraint {
+		case "":
+			config.LocationConstraint = "us-east-1"
+		case "EU":
+			config.LocationConstraint = "eu-west-1"
+		}
+		if !regionNamePattern.MatchString(config.LocationConstraint) {
+			s3err(w, ErrInvalidLocationConstraint)
+			return nil
+		}
+		if config.LocationConstraint != s3region {
+			s3err(w, ErrIllegalLocationConstraint)
+			log.Printf("CreateBucket %s: location %s does not match region %s", bucketName, config.LocationConstraint, s3region)
+			return nil
+		}
+		region = config.LocationConstraint
+	}
+
 	// Check if bucket exists
-	bucketPath := filepath.Join(bucketPath, bucketName)
-	if _, err = os.Stat(bucketPath); os.IsNotExist(err) {
-		if err = os.MkdirAll(bucketPath, 0755); err != nil {
-			s3err(w, ErrInternalError)
-			return
+	bucketPath := bucketDir(bucketName)
+	if err = os.Mkdir(bucketPath, 0755); err != nil {
+		if os.IsExist(err) {
+			s3err(w, ErrBucketAlreadyOwnedByYou)
+			return nil
 		}
-		w.WriteHeader(http.StatusCreated)
+		s3err(w, ErrInternalError)
+		log.Printf("Error creating bucket %s : %s", bucketName, err)
+		return
+	}
+
+	meta := BucketMeta{Created: time.Now().UTC(), Region: region}
+	if id := requestIdentity(r); id != nil {
+		meta.Owner = id.AccessKeyId
+	}
+	if strings.EqualFold(r.Header.Get("x-amz-bucket-object-lock-enabled"), "true") {
+		meta.ObjectLock = &XmlObjectLockConfiguration{ObjectLockEnabled: "Enabled"}
+	}
+	if err = saveBucketMeta(bucketName, &meta); err != nil {
+		os.Remove(bucketPath)
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving metadata of bucket %s : %s", bucketName, err)
+		return
+	}
+
+	w.Header().Set("Location", "/"+bucketName)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLocation.html
+type XmlLocationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+func getBucketLocation(w http.ResponseWriter, r *http.Request, bucketName string) error {
+
+	// buckets in us-east-1 have null location constraint
+	response := XmlLocationConstraint{}
+	if region := bucketRegion(bucketName); region != "us-east-1" {
+		response.Location = region
+	}
+
+	return writeXML(w, response)
+}
+
+// writeXML sends 200 response with marshalled v
+func writeXML(w http.ResponseWriter, v interface{}) error {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucket.html
+// Only empty buckets are deleted unless an admin sends x-gos3rve-force-delete: true
+func deleteBucket(w http.ResponseWriter, r *http.Request, bucketName string) (err error) {
+
+	force := strings.EqualFold(r.Header.Get(forceDeleteHeader), "true")
+	if force && !isAdminRequest(r) {
+		s3err(w, ErrAccessDenied)
+		return nil
+	}
+
+	// no object gets written (or locked) between the check below and removal
+	unlock := objectLocks.LockBucket(bucketName)
+	defer unlock()
+
+	// locked objects can't go with the bucket either
+	if force && bucketHasLockedObjects(bucketName) {
+		s3err(w, ErrAccessDenied)
+		log.Printf("Refusing to force delete bucket %s with locked objects", bucketName)
+		return nil
+	}
+
+	bucketPath := bucketDir(bucketName)
+	if force {
+		log.Printf("Force deleting bucket %s with all its content", bucketName)
+		err = os.RemoveAll(bucketPath)
 	} else {
-		w.WriteHeader(http.StatusOK)
+		err = os.Remove(bucketPath)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST):
+			s3err(w, ErrBucketNotEmpty)
+		case os.IsPermission(err):
+			s3err(w, ErrAccessDenied)
+		default:
+			s3err(w, ErrInternalError)
+		}
+		log.Printf("Error deleting bucket %s : %s", bucketName, err)
+		return err
+	}
+
+	// metadata of the objects and uploads in progress go with the bucket
+	if err := os.RemoveAll(filepath.Join(metaPath, bucketName)); err != nil {
+		log.Printf("Error removing metadata of bucket %s : %s", bucketName, err)
 	}
+	removeBucketUploads(bucketName)
+
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
@@ -67,8 +218,8 @@ func listBuckets(w http.ResponseWriter, r *http.Request, localPath string) (err
 	for _, file := range files {
 
 		if file.IsDir() {
-			mtime := file.ModTime().Format(time.RFC3339)
-			entry := fmt.Sprintf("\t\t<Bucket><CreationDate>%s</CreationDate><Name>%s</Name></Bucket>\n", mtime, file.Name())
+			created := bucketCreationDate(file.Name(), file).Format(time.RFC3339)
+			entry := fmt.Sprintf("\t\t<Bucket><CreationDate>%s</CreationDate><Name>%s</Name></Bucket>\n", created, file.Name())
 			buffer.WriteString(entry)
 		}
 
@@ -88,17 +239,101 @@ func listBuckets(w http.ResponseWriter, r *http.Request, localPath string) (err
 	return nil
 }
 
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_CreateMultipartUpload.html
+func createMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+
+	// Check if bucket exists
+	fstat, _ := os.Stat(filePath)
+
+	if fstat != nil && fstat.IsDir() && keyEncoding != keyEncodingEncode {
+		s3err(w, ErrExistingObjectIsDirectory)
+		return nil
+	}
+
+	algorithm, checksumType, code := parseChecksumType(r.Header.Get("x-amz-checksum-algorithm"), r.Header.Get("x-amz-checksum-type"))
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	tags, code := parseTaggingHeader(r)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	lock, code := parseObjectLockHeaders(r, bucketName)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	enc, _, code := parseSSERequest(r, bucketName)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	upload := MultipartUpload{
+		UploadId:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Bucket:            bucketName,
+		Key:               objectKey,
+		Initiated:         time.Now().UTC(),
+		ChecksumAlgorithm: algorithm,
+		ChecksumType:      checksumType,
+		Tags:              tags,
+		ObjectLockState:   lock,
+		Encryption:        enc,
+	}
+
+	if err := saveMultipartUpload(&upload); err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving upload record for %s : %s", filePath, err)
+		return err
+	}
+
+	s := fmt.Sprintf(`
+		<InitiateMultipartUploadResult>
+			<Bucket>%s</Bucket>
+			<Key>%s</Key>
+			<UploadId>%s</UploadId>
+		</InitiateMultipartUploadResult>
+`, bucketName, EscapeStringForXML(objectKey), upload.UploadId)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(s)
+
+	w.Header().Set("x-amz-checksum-algorithm", algorithm)
+	w.Header().Set("x-amz-checksum-type", checksumType)
+	setSSEHeaders(w, enc)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+	log.Printf("Multipart upload intiated for %s  (bucket: %s ; object: %s)", r.URL.Path, bucketName, objectKey)
+	return nil
+}
+
 // Define a struct to represent the XML structure
 type XmlMultipartUploadPart struct {
 	PartNumber int    `xml:"PartNumber"`
 	ETag       string `xml:"ETag"`
+	XmlChecksums
 }
 
 type XmlCompleteMultipartUpload struct {
 	Parts []XmlMultipartUploadPart `xml:"Part"`
 }
 
-func finilizeMultipartUpload(w http.ResponseWriter, r *http.Request, bucketPath string, objectKey string) error {
+type XmlCompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+	XmlChecksums
+	ChecksumType string `xml:"ChecksumType,omitempty"`
+}
+
+func finilizeMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, dstFilePath string) error {
 
 	_, _, uploadId, _ := isMultiPartUpload(r)
 
@@ -113,25 +348,83 @@ func finilizeMultipartUpload(w http.ResponseWriter, r *http.Request, bucketPath
 	var data XmlCompleteMultipartUpload
 	err = xml.Unmarshal(objectContent, &data)
 	if err != nil {
+		s3err(w, ErrMalformedXML)
 		fmt.Println("Error parsing XML:", err)
 		return err
 	}
 
-	dstFilePath := filepath.Join(bucketPath, objectKey)
+	if code := prepareObjectDirs(bucketName, dstFilePath); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
 
-	dstFile, err := os.OpenFile(dstFilePath, os.O_TRUNC|os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	// object is assembled in temp file so that existing version stays intact
+	// until the upload is complete
+	dstFile, err := createTempFile(dstFilePath)
 	if err != nil {
+		s3err(w, ErrInternalError)
 		fmt.Println("Error opening file:", err)
 		return err
 	}
-	defer dstFile.Close()
+
+	committed := false
+	defer func() {
+		if !committed {
+			discardTempFile(dstFile)
+		}
+	}()
+
+	// part boundaries are recorded so that parts can be served individually later
+	var meta ObjectMeta
+	var partSums [][]byte
+	var partFiles []string
+	var offset int64
+
+	// checksums of parts and of the whole object (for FULL_OBJECT checksum type)
+	var partChecksums []string
+	var fullChecksum hash.Hash
+
+	// parts of encrypted uploads are decrypted and the object is encrypted
+	// again with a data key of its own
+	var partEnc *ObjectEncryption
+	dst := io.Writer(dstFile)
+	var encrypter *sseWriter
+
+	if upload := loadMultipartUpload(uploadId); upload != nil {
+		meta.Tags = upload.Tags
+		meta.ObjectLockState = upload.ObjectLockState
+		if upload.ChecksumAlgorithm != "" {
+			meta.ChecksumAlgorithm = upload.ChecksumAlgorithm
+			meta.ChecksumType = upload.ChecksumType
+			fullChecksum = checksumAlgorithms[upload.ChecksumAlgorithm]()
+		}
+
+		if code := checkSSECustomerKey(r, upload.Encryption, ssecHeaderPrefix); code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+
+		if upload.Encryption != nil {
+			partEnc = upload.Encryption
+			var dataKey []byte
+			if meta.Encryption, dataKey, err = partEnc.renew(); err == nil {
+				encrypter, err = newSSEWriter(dstFile, dataKey)
+			}
+			if err != nil {
+				s3err(w, ErrInternalError)
+				log.Printf("CompleteMultipartUpload: Error encrypting %s : %s", dstFilePath, err)
+				return err
+			}
+			dst = encrypter
+		}
+	}
 
 	for _, part := range data.Parts {
 		srcFile := filepath.Dir(dstFilePath) + "/" + uploadId + "_" + strconv.FormatInt(int64(part.PartNumber), 10) + "_" + filepath.Base(dstFilePath)
 
 		// Open the binary file for reading
 
-		objectContent, err := os.ReadFile(srcFile)
+		objectContent, err := readPartFile(srcFile, partEnc)
 		if err != nil {
 			s3err(w, ErrInternalError)
 			log.Printf("CompleteMultipartUpload: failed to read from  %s  rtt: %s", srcFile, err.Error())
@@ -146,7 +439,8 @@ func finilizeMultipartUpload(w http.ResponseWriter, r *http.Request, bucketPath
 			return err
 		}
 
-		hash_str := hex.EncodeToString(hash.Sum(nil))
+		sum := hash.Sum(nil)
+		hash_str := hex.EncodeToString(sum)
 		if strings.Compare(part.ETag, hash_str) != 0 {
 			s3err(w, ErrSignatureDoesNotMatch)
 			log.Printf("CompleteMultipartUpload: part's signatures do not match (local: %s != client: %s) ",
@@ -157,26 +451,146 @@ func finilizeMultipartUpload(w http.ResponseWriter, r *http.Request, bucketPath
 		}
 
 		// Append data to the file
-		_, err = dstFile.Write(objectContent)
+		_, err = dst.Write(objectContent)
 		if err != nil {
 			s3err(w, ErrInternalError)
 			log.Println("CompleteMultipartUpload: Error while writing into file ", dstFilePath, " ", err.Error())
 			return err
 		}
 
+		partChecksum := ""
+		if fullChecksum != nil {
+			h := checksumAlgorithms[meta.ChecksumAlgorithm]()
+			h.Write(objectContent)
+			partChecksum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+			if expected := part.Get(meta.ChecksumAlgorithm); expected != "" && expected != partChecksum {
+				s3err(w, ErrInvalidPart)
+				log.Printf("CompleteMultipartUpload: part's %s checksums do not match (local: %s != client: %s) ",
+					meta.ChecksumAlgorithm, partChecksum, expected)
+				return nil
+			}
+
+			fullChecksum.Write(objectContent)
+			partChecksums = append(partChecksums, partChecksum)
+		}
+
+		meta.Parts = append(meta.Parts, ObjectPart{
+			PartNumber: part.PartNumber,
+			Offset:     offset,
+			Size:       int64(len(objectContent)),
+			ETag:       hash_str,
+			Checksum:   partChecksum,
+		})
+		partSums = append(partSums, sum)
+		partFiles = append(partFiles, srcFile)
+		offset += int64(len(objectContent))
+
+		if limit := objectSizeLimit(); limit > 0 && offset > limit {
+			s3err(w, ErrEntityTooLarge)
+			return nil
+		}
+	}
+
+	if fullChecksum != nil {
+		if meta.ChecksumType == checksumTypeComposite {
+			meta.Checksum, err = compositeChecksum(meta.ChecksumAlgorithm, partChecksums)
+			if err != nil {
+				s3err(w, ErrInternalError)
+				return err
+			}
+		} else {
+			meta.Checksum = base64.StdEncoding.EncodeToString(fullChecksum.Sum(nil))
+		}
+
+		// client may send checksum of the whole object with the complete request
+		checksumReq, code := parseChecksumRequest(r)
+		if code == ErrNone && checksumReq.algorithm != "" && checksumReq.algorithm != meta.ChecksumAlgorithm {
+			code = ErrInvalidRequest
+		}
+		if code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+
+		expected, _, _ := strings.Cut(checksumReq.expected, "-")
+		actual, _, _ := strings.Cut(meta.Checksum, "-")
+		if expected != "" && expected != actual {
+			s3err(w, ErrBadDigest)
+			log.Printf("CompleteMultipartUpload: %s checksum of %s does not match (local: %s != client: %s)",
+				meta.ChecksumAlgorithm, dstFilePath, meta.Checksum, checksumReq.expected)
+			return nil
+		}
+	}
+
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			s3err(w, ErrInternalError)
+			log.Println("CompleteMultipartUpload: Error while writing into file ", dstFilePath, " ", err.Error())
+			return err
+		}
+		meta.Encryption.Size = offset
+	}
+
+	unlock := objectLocks.Lock(bucketName, objectKey)
+	defer unlock()
+
+	dstFilePath, code := objectWritePath(dstFilePath)
+	if code == ErrNone {
+		code = checkObjectLock(r, bucketName, objectKey, dstFilePath)
+	}
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	meta.ETag = multipartETag(partSums)
+
+	committed = true
+	if _, err = commitObject(dstFile, dstFilePath, bucketName, objectKey, &meta); err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("CompleteMultipartUpload: Error committing %s : %s", dstFilePath, err)
+		return err
+	}
+
+	// parts are no longer needed once object is in place
+	for _, srcFile := range partFiles {
 		err = os.Remove(srcFile)
 		if err != nil {
 			log.Printf("CompleteMultipartUpload: Error wile deleting %s , err: %s", srcFile, err.Error())
 		}
+	}
+	removeMultipartUpload(uploadId)
+
+	result := XmlCompleteMultipartUploadResult{
+		Location: r.URL.Path,
+		Bucket:   bucketName,
+		Key:      objectKey,
+		ETag:     meta.ETag,
+	}
+
+	if meta.Checksum != "" {
+		result.Set(meta.ChecksumAlgorithm, meta.Checksum)
+		result.ChecksumType = meta.ChecksumType
+	}
 
+	out, err := xml.Marshal(result)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
 	}
 
-	log.Printf("Multipart upload finished  for %s  (local path: %s ; object: %s)", r.URL.Path, bucketPath, objectKey)
+	w.Header().Set("Content-Type", "application/xml")
+	setSSEHeaders(w, meta.Encryption)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+
+	log.Printf("Multipart upload finished  for %s  (local path: %s ; object: %s)", r.URL.Path, dstFilePath, objectKey)
 
 	return nil
 }
 
-func putObject(w http.ResponseWriter, r *http.Request, path string, is_dir bool) (err error) {
+func putObject(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, path string, is_dir bool) (err error) {
 
 	//request to create directory ?
 	if is_dir {
@@ -200,30 +614,116 @@ func putObject(w http.ResponseWriter, r *http.Request, path string, is_dir bool)
 	//if it is a multipart upload , modify filePath
 	_, isMulti, uploadId, partNumber := isMultiPartUpload(r)
 	if isMulti {
+		if !isValidUploadId(uploadId) {
+			s3err(w, ErrNoSuchUpload)
+			return nil
+		}
+		if n, err := strconv.Atoi(partNumber); err != nil || n < 1 || n > 10000 {
+			s3err(w, ErrInvalidArgument)
+			return nil
+		}
 		path = filepath.Dir(path) + "/" + uploadId + "_" + partNumber + "_" + filepath.Base(path)
 		//filePath = filePath + "_" + uploadId + "_" + partNumber
 	}
 
-	// make sure parent dir exists and create if it does not
-	dirPath := filepath.Dir(path)
-	if err = os.MkdirAll(dirPath, 0755); err != nil {
-		s3err(w, ErrInternalError)
-		log.Println("Error while creating parent directories")
-		return
+	// tags and object lock are set on the object only, parts get them from
+	// their upload
+	var tags map[string]string
+	var lock ObjectLockState
+	if !isMulti {
+		var code ErrorCode
+		if tags, code = parseTaggingHeader(r); code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+		if lock, code = parseObjectLockHeaders(r, bucketName); code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+	}
+
+	// objects get their own data key, parts use the key of their upload
+	var enc *ObjectEncryption
+	var dataKey []byte
+	if isMulti {
+		if upload := loadMultipartUpload(uploadId); upload != nil {
+			// parts of SSE-C uploads must come with the key of the upload
+			if code := checkSSECustomerKey(r, upload.Encryption, ssecHeaderPrefix); code != ErrNone {
+				s3err(w, code)
+				return nil
+			}
+			enc = upload.Encryption
+		}
+		if enc != nil {
+			if dataKey, err = enc.dataKey(); err != nil {
+				s3err(w, ErrInternalError)
+				log.Printf("Error unwrapping data key of upload %s : %s", uploadId, err)
+				return err
+			}
+		}
+	} else {
+		var code ErrorCode
+		if enc, dataKey, code = parseSSERequest(r, bucketName); code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+	}
+
+	// checksum requested by the client. Parts use the algorithm of their upload,
+	// objects w/o explicit algorithm get CRC64NVME (like in S3)
+	checksumReq, code := parseChecksumRequest(r)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	if isMulti {
+		if upload := loadMultipartUpload(uploadId); upload != nil {
+			if checksumReq.algorithm != "" && checksumReq.algorithm != upload.ChecksumAlgorithm {
+				s3err(w, ErrInvalidRequest)
+				return nil
+			}
+			checksumReq.algorithm = upload.ChecksumAlgorithm
+		}
+	} else if checksumReq.algorithm == "" {
+		checksumReq.algorithm = checksumCRC64NVME
+	}
+
+	body := io.Reader(r.Body)
+	var chunked *awsChunkedReader
+	declaredSize := r.ContentLength
+	if isAWSChunked(r) {
+		chunked = newAWSChunkedReader(r.Body)
+		body = chunked
+		declaredSize, _ = strconv.ParseInt(r.Header.Get("x-amz-decoded-content-length"), 10, 64)
+	}
+
+	// size is checked up front when declared, otherwise while reading the body
+	sizeLimit := objectSizeLimit()
+	if sizeLimit > 0 && declaredSize > sizeLimit {
+		s3err(w, ErrEntityTooLarge)
+		return nil
+	}
+
+	if code = prepareObjectDirs(bucketName, path); code != ErrNone {
+		s3err(w, code)
+		return nil
 	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	// data goes into temp file which replaces destination only once the whole
+	// body has been received
+	file, err := createTempFile(path)
 	if err != nil {
 		s3err(w, ErrInternalError)
-		log.Printf("Error  creatig file %s", path)
+		log.Printf("Error  creatig temp file for %s : %s", path, err)
 		return
 	}
 
+	committed := false
 	defer func() {
-		file.Close()
-		// If there was an error, delete file
-		if err != nil {
-			os.Remove(file.Name())
+		// If there was an error, previous version of the object stays intact
+		if !committed {
+			discardTempFile(file)
 		}
 	}()
 
@@ -235,10 +735,22 @@ func putObject(w http.ResponseWriter, r *http.Request, path string, is_dir bool)
 	n := 0
 
 	hash := md5.New()
+	checksum := newChecksumVerifier(checksumReq)
+
+	out := io.Writer(file)
+	var encrypter *sseWriter
+	if dataKey != nil {
+		if encrypter, err = newSSEWriter(file, dataKey); err != nil {
+			s3err(w, ErrInternalError)
+			log.Printf("Error writing into file %s , err %s", path, err)
+			return err
+		}
+		out = encrypter
+	}
 
 	// Loop to read the request body in chunks
 	for {
-		n, err = r.Body.Read(buffer)
+		n, err = body.Read(buffer)
 		if err != nil && err != io.EOF {
 			s3err(w, ErrInternalError)
 			log.Println("Error reading request data")
@@ -250,14 +762,21 @@ func putObject(w http.ResponseWriter, r *http.Request, path string, is_dir bool)
 			break
 		}
 
+		if sizeLimit > 0 && int64(totalSize+n) > sizeLimit {
+			s3err(w, ErrEntityTooLarge)
+			return nil
+		}
+
 		if _, err = hash.Write(buffer[:n]); err != nil {
 			s3err(w, ErrInternalError)
 			log.Println("Error while calculating md5 ", err.Error())
 			return
 		}
 
+		checksum.Write(buffer[:n])
+
 		// Write data to the file
-		_, err = file.Write(buffer[:n])
+		_, err = out.Write(buffer[:n])
 		if err != nil {
 			s3err(w, ErrInternalError)
 			log.Printf("Error writing into file %s , err %s", path, err)
@@ -268,82 +787,656 @@ func putObject(w http.ResponseWriter, r *http.Request, path string, is_dir bool)
 		totalSize += n
 	}
 
-	hash_str := hex.EncodeToString(hash.Sum(nil))
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			s3err(w, ErrInternalError)
+			log.Printf("Error writing into file %s , err %s", path, err)
+			return err
+		}
+	}
 
-	w.Header().Set("ETag", hash_str)
-	w.WriteHeader(http.StatusCreated)
+	hash_str := hex.EncodeToString(hash.Sum(nil))
 
-	return nil
-}
+	if code = checksum.Verify(chunked); code != ErrNone {
+		s3err(w, code)
+		log.Printf("Checksum verification failed for %s (%s)", path, checksumReq.algorithm)
+		return nil
+	}
 
-func getObject(w http.ResponseWriter, r *http.Request, filePath string) error {
+	// parts of multipart uploads are private to their upload, objects
+	// themselves are replaced (data and metadata) under the key lock
+	if !isMulti {
+		unlock := objectLocks.Lock(bucketName, objectKey)
+		defer unlock()
 
-	// Check if file exists
-	fstat, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		s3err(w, ErrNoSuchKey)
-		return err
+		if path, code = objectWritePath(path); code == ErrNone {
+			code = checkObjectLock(r, bucketName, objectKey, path)
+		}
+		if code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
 	}
 
-	// Read file content
-	fileContent, err := os.ReadFile(filePath)
-	if err != nil {
-		s3err(w, ErrInternalError)
-		return err
+	committed = true
+	if isMulti {
+		// parts of multipart uploads get their metadata once upload is completed
+		err = commitTempFile(file, path)
+	} else {
+		meta := ObjectMeta{
+			ETag:              hash_str,
+			ChecksumAlgorithm: checksumReq.algorithm,
+			ChecksumType:      checksumTypeFullObject,
+			Checksum:          checksum.Sum(),
+			Tags:              tags,
+			ObjectLockState:   lock,
+		}
+		if enc != nil {
+			meta.Encryption = enc
+			meta.Encryption.Size = int64(totalSize)
+		}
+		_, err = commitObject(file, path, bucketName, objectKey, &meta)
 	}
-
-	hash := md5.New()
-	if _, err = hash.Write(fileContent); err != nil {
+	if err != nil {
 		s3err(w, ErrInternalError)
-		log.Println("Error while calculating md5 ", err.Error())
+		log.Printf("Error committing %s : %s", path, err)
 		return err
 	}
 
-	hash_str := hex.EncodeToString(hash.Sum(nil))
+	setSSEHeaders(w, enc)
 
+	if checksumReq.algorithm != "" {
+		w.Header().Set(checksumHeader(checksumReq.algorithm), checksum.Sum())
+	}
 	w.Header().Set("ETag", hash_str)
-	w.Header().Set("Content-Type", http.DetectContentType(fileContent))
-	w.Header().Set("content-length", strconv.FormatInt(fstat.Size(), 10))
-	w.Write(fileContent)
+	w.WriteHeader(http.StatusCreated)
 
 	return nil
 }
 
-func getObjectHead(w http.ResponseWriter, r *http.Request, filePath string) error {
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_CopyObject.html
+type XmlCopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+	XmlChecksums
+}
+
+// parseCopySource splits x-amz-copy-source ("/bucket/key" or "bucket/key",
+// URL encoded, optionally with ?versionId=) into bucket and key
+func parseCopySource(r *http.Request) (string, string, ErrorCode) {
+	source := r.Header.Get("x-amz-copy-source")
+	source, _, _ = strings.Cut(source, "?")
+
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return "", "", ErrInvalidCopySource
+	}
+
+	bucketName, objectKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if bucketName == "" || objectKey == "" {
+		return "", "", ErrInvalidCopySource
+	}
+
+	return bucketName, objectKey, ErrNone
+}
+
+// PUT /{bucket}/{key} with x-amz-copy-source
+func copyObject(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	srcBucket, srcKey, code := parseCopySource(r)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	if !isSafeBucketName(srcBucket) {
+		s3err(w, ErrInvalidBucketName)
+		return nil
+	}
+	if _, err := os.Stat(bucketDir(srcBucket)); os.IsNotExist(err) {
+		s3err(w, ErrNoSuchBucket)
+		return nil
+	}
+
+	// the requester has to be allowed to read the source as well
+	if !isRequestAllowed(r, "s3:GetObject", srcBucket, srcKey) {
+		s3err(w, ErrAccessDenied)
+		return nil
+	}
+
+	srcPath, code := resolveObjectPath(srcBucket, srcKey)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	metadataDirective := r.Header.Get("x-amz-metadata-directive")
+	taggingDirective := r.Header.Get("x-amz-tagging-directive")
+	for _, directive := range []string{metadataDirective, taggingDirective} {
+		if directive != "" && directive != "COPY" && directive != "REPLACE" {
+			s3err(w, ErrInvalidArgument)
+			return nil
+		}
+	}
+
+	// copying object onto itself has to change something (encryption
+	// included, that's how existing objects get encrypted)
+	if srcBucket == bucketName && srcKey == objectKey && metadataDirective != "REPLACE" && taggingDirective != "REPLACE" &&
+		r.Header.Get("x-amz-server-side-encryption") == "" && r.Header.Get(ssecHeaderPrefix+"algorithm") == "" {
+		s3err(w, ErrInvalidCopyDest)
+		return nil
+	}
+
+	var tags map[string]string
+	if taggingDirective == "REPLACE" {
+		if tags, code = parseTaggingHeader(r); code != ErrNone {
+			s3err(w, code)
+			return nil
+		}
+	}
+
+	// object lock and encryption settings are not copied from the source
+	lock, code := parseObjectLockHeaders(r, bucketName)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	enc, dataKey, code := parseSSERequest(r, bucketName)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	checksumReq, code := parseChecksumRequest(r)
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	// source is opened under its lock, the open file stays readable even if
+	// the object gets replaced while being copied
+	unlock := objectLocks.RLock(srcBucket, srcKey)
+	src, err := os.Open(objectFilePath(srcPath))
+	var srcStat os.FileInfo
+	if err == nil {
+		srcStat, err = src.Stat()
+	}
+	if err != nil || srcStat.IsDir() || isDirKey(srcKey) {
+		unlock()
+		if src != nil {
+			src.Close()
+		}
+		s3err(w, ErrNoSuchKey)
+		return nil
+	}
+	srcMeta := loadObjectMeta(srcBucket, srcKey, srcStat)
+	unlock()
+	defer src.Close()
+
+	if srcMeta.encryption() == nil && isEncryptedFile(src) {
+		s3err(w, ErrInternalError)
+		log.Printf("Error copying %s/%s : encrypted object without metadata", srcBucket, srcKey)
+		return nil
+	}
+
+	if code := checkSSECustomerKey(r, srcMeta.encryption(), ssecCopySourcePrefix); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	srcReader, srcSize, err := objectReader(src, srcStat, srcMeta)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error decrypting %s/%s : %s", srcBucket, srcKey, err)
+		return err
+	}
+
+	if limit := objectSizeLimit(); limit > 0 && srcSize > limit {
+		s3err(w, ErrEntityTooLarge)
+		return nil
+	}
+
+	if taggingDirective != "REPLACE" && srcMeta != nil {
+		tags = srcMeta.Tags
+	}
+
+	// copy keeps checksum algorithm of the source unless asked otherwise
+	if checksumReq.algorithm == "" && srcMeta != nil {
+		checksumReq.algorithm = srcMeta.ChecksumAlgorithm
+	}
+	if checksumReq.algorithm == "" {
+		checksumReq.algorithm = checksumCRC64NVME
+	}
+	checksumReq.expected = ""
+
+	if code = prepareObjectDirs(bucketName, filePath); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	file, err := createTempFile(filePath)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error  creatig temp file for %s : %s", filePath, err)
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			discardTempFile(file)
+		}
+	}()
+
+	dst := io.Writer(file)
+	var encrypter *sseWriter
+	if dataKey != nil {
+		if encrypter, err = newSSEWriter(file, dataKey); err != nil {
+			s3err(w, ErrInternalError)
+			log.Printf("Error encrypting %s : %s", filePath, err)
+			return err
+		}
+		dst = encrypter
+	}
+
+	hash := md5.New()
+	checksum := newChecksumVerifier(checksumReq)
+	_, err = io.Copy(io.MultiWriter(dst, hash, checksum), io.NewSectionReader(srcReader, 0, srcSize))
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error copying %s/%s to %s/%s : %s", srcBucket, srcKey, bucketName, objectKey, err)
+		return err
+	}
+
+	unlockDst := objectLocks.Lock(bucketName, objectKey)
+	defer unlockDst()
+
+	if filePath, code = objectWritePath(filePath); code == ErrNone {
+		code = checkObjectLock(r, bucketName, objectKey, filePath)
+	}
+	if code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	meta := ObjectMeta{
+		ETag:              hex.EncodeToString(hash.Sum(nil)),
+		ChecksumAlgorithm: checksumReq.algorithm,
+		ChecksumType:      checksumTypeFullObject,
+		Checksum:          checksum.Sum(),
+		Tags:              tags,
+		ObjectLockState:   lock,
+	}
+	if enc != nil {
+		meta.Encryption = enc
+		meta.Encryption.Size = srcSize
+	}
+
+	committed = true
+	fstat, err := commitObject(file, filePath, bucketName, objectKey, &meta)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error committing %s : %s", filePath, err)
+		return err
+	}
+
+	result := XmlCopyObjectResult{
+		ETag:         meta.ETag,
+		LastModified: fstat.ModTime().UTC().Format(time.RFC3339),
+	}
+	result.Set(meta.ChecksumAlgorithm, meta.Checksum)
+
+	setSSEHeaders(w, enc)
+	return writeXML(w, result)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteObject.html
+// Deleting a key which does not exist is not an error. Directories left empty
+// are removed, so that the prefix disappears along with its last object.
+func deleteObject(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+
+	// objects under retention or legal hold stay
+	locked := ErrNone
+	keep := func(fstat os.FileInfo) bool {
+		if meta := loadObjectMeta(bucketName, objectKey, fstat); meta != nil {
+			locked = meta.lockError(canBypassGovernance(r, bucketName, objectKey))
+		}
+		return locked != ErrNone
+	}
+
+	_, err := removeObject(bucketName, objectKey, filePath, keep)
+	if locked != ErrNone {
+		s3err(w, locked)
+		log.Printf("Refusing to delete locked object %s/%s", bucketName, objectKey)
+		return nil
+	}
+	if err != nil {
+		if os.IsPermission(err) {
+			s3err(w, ErrAccessDenied)
+		} else {
+			s3err(w, ErrInternalError)
+		}
+		log.Printf("Error deleting %s : %s", filePath, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeObject deletes object stored at filePath (as resolved for objectKey)
+// with its metadata and prunes directories left empty. If keep is set, it is
+// consulted under the key lock and can veto the removal. Returns whether
+// there was an object to remove.
+func removeObject(bucketName string, objectKey string, filePath string, keep func(fstat os.FileInfo) bool) (bool, error) {
+
+	unlock := objectLocks.Lock(bucketName, objectKey)
+	defer unlock()
+
+	filePath = objectFilePath(filePath)
 
-	// Check if file exists
 	fstat, err := os.Stat(filePath)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// directory is an object only when created as "dir/" (and empty),
+	// otherwise it is just a prefix of other keys; "dir/" never is a file
+	if fstat.IsDir() != isDirKey(objectKey) {
+		return false, nil
+	}
+
+	if keep != nil && keep(fstat) {
+		return false, nil
+	}
+
+	err = os.Remove(filePath)
+	if fstat.IsDir() && (errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)) {
+		return false, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	removeObjectMeta(bucketName, objectKey)
+	pruneEmptyDirs(bucketDir(bucketName), filepath.Dir(filePath))
+
+	return err == nil, nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_AbortMultipartUpload.html
+func abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string, uploadId string) error {
+
+	if !isValidUploadId(uploadId) {
+		s3err(w, ErrNoSuchUpload)
+		return nil
+	}
+
+	upload := loadMultipartUpload(uploadId)
+	if upload != nil && (upload.Bucket != bucketName || upload.Key != objectKey) {
+		s3err(w, ErrNoSuchUpload)
+		return nil
+	}
+
+	removed := removeUploadParts(bucketName, filePath, uploadId)
+	if upload == nil && removed == 0 {
+		s3err(w, ErrNoSuchUpload)
+		return nil
+	}
+	removeMultipartUpload(uploadId)
+
+	log.Printf("Multipart upload %s aborted for %s (%d parts removed)", uploadId, objectKey, removed)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeUploadParts deletes parts uploaded for the object at filePath, they are
+// stored as <uploadId>_<partNumber>_<name> next to the object
+func removeUploadParts(bucketName string, filePath string, uploadId string) int {
+	dir, base := filepath.Dir(filePath), filepath.Base(filePath)
+	entries, _ := os.ReadDir(dir)
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, uploadId+"_") || !strings.HasSuffix(name, "_"+base) {
+			continue
+		}
+		partNumber := strings.TrimSuffix(strings.TrimPrefix(name, uploadId+"_"), "_"+base)
+		if _, err := strconv.Atoi(partNumber); err != nil {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Printf("Error deleting part %s : %s", name, err)
+			continue
+		}
+		removed++
+	}
+
+	pruneEmptyDirs(bucketDir(bucketName), dir)
+	return removed
+}
+
+// pruneEmptyDirs removes dir and its parents up to (but excluding) root as long
+// as they are empty
+func pruneEmptyDirs(root string, dir string) {
+	for dir != root && isWithinDir(root, dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func getObject(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	return serveObject(w, r, bucketName, objectKey, filePath, true)
+}
+
+func getObjectHead(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	return serveObject(w, r, bucketName, objectKey, filePath, false)
+}
+
+// serveObject writes object headers (and content if withBody is set) for GET/HEAD.
+// ?partNumber=N narrows response down to a single part of (multipart) object.
+func serveObject(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string, withBody bool) error {
+
+	// data file and its metadata are picked up consistently under the key lock,
+	// afterwards the open descriptor keeps serving this version of the object
+	unlock := objectLocks.RLock(bucketName, objectKey)
+
+	file, err := os.Open(objectFilePath(filePath))
 	if os.IsNotExist(err) {
+		unlock()
 		s3err(w, ErrNoSuchKey)
 		return err
 	}
+	if err != nil {
+		unlock()
+		s3err(w, ErrInternalError)
+		return err
+	}
+	defer file.Close()
 
-	// Read file content
-	fileContent, err := ioutil.ReadFile(filePath)
+	fstat, err := file.Stat()
 	if err != nil {
-		http.Error(w, "Failed to read object content", http.StatusInternalServerError)
+		unlock()
+		s3err(w, ErrInternalError)
 		return err
 	}
+	if fstat.IsDir() {
+		unlock()
+		s3err(w, ErrNoSuchKey)
+		return nil
+	}
 
-	hash := md5.New()
-	if _, err = hash.Write(fileContent); err != nil {
+	meta := loadObjectMeta(bucketName, objectKey, fstat)
+	unlock()
+
+	if meta.encryption() == nil && isEncryptedFile(file) {
+		s3err(w, ErrInternalError)
+		log.Printf("Error serving %s : encrypted object without metadata", filePath)
+		return nil
+	}
+
+	if code := checkSSECustomerKey(r, meta.encryption(), ssecHeaderPrefix); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	reader, size, err := objectReader(file, fstat, meta)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error decrypting %s : %s", filePath, err)
+		return err
+	}
+
+	hash_str, err := objectETag(file, meta)
+	if err != nil {
 		s3err(w, ErrInternalError)
 		log.Println("Error while calculating md5 ", err.Error())
 		return err
 	}
 
-	hash_str := hex.EncodeToString(hash.Sum(nil))
+	offset, length := int64(0), size
+	status := http.StatusOK
+
+	// checksum of the whole object (or of the requested part, see below)
+	checksumValue := ""
+	if meta != nil {
+		checksumValue = meta.Checksum
+	}
+
+	if pn := r.URL.Query().Get("partNumber"); pn != "" {
+		partNumber, err := strconv.Atoi(pn)
+		if err != nil || partNumber < 1 {
+			s3err(w, ErrInvalidPartNumber)
+			return err
+		}
+
+		part, ok := objectPart(meta, size, partNumber)
+		if !ok {
+			s3err(w, ErrInvalidPartNumber)
+			return nil
+		}
+		offset, length, checksumValue = part.Offset, part.Size, part.Checksum
+
+		if meta != nil && len(meta.Parts) > 0 {
+			w.Header().Set("x-amz-mp-parts-count", strconv.Itoa(len(meta.Parts)))
+		}
+		// an empty part has no byte range to report
+		if length > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+			status = http.StatusPartialContent
+		}
+	} else if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, ok, valid := parseRange(rangeHeader, size)
+		if !valid {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			s3err(w, ErrInvalidRange)
+			return nil
+		}
+		if ok {
+			offset, length = start, end-start+1
+			// checksum of the whole object doesn't describe the range
+			checksumValue = ""
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+			status = http.StatusPartialContent
+		}
+	}
+
+	if checksumValue != "" && isChecksumModeEnabled(r) {
+		w.Header().Set(checksumHeader(meta.ChecksumAlgorithm), checksumValue)
+		w.Header().Set("x-amz-checksum-type", meta.ChecksumType)
+	}
+
+	setObjectLockHeaders(w, meta)
+	if meta != nil && len(meta.Tags) > 0 {
+		w.Header().Set("x-amz-tagging-count", strconv.Itoa(len(meta.Tags)))
+	}
+	if meta != nil {
+		setSSEHeaders(w, meta.Encryption)
+	}
+
+	// sniff content type from the beginning of the object
+	sniff := make([]byte, 512)
+	n, _ := reader.ReadAt(sniff, 0)
+
+	// damaged encrypted data is better reported before the headers go out
+	if length > 0 {
+		if _, err = reader.ReadAt(make([]byte, 1), offset); err != nil && err != io.EOF {
+			s3err(w, ErrInternalError)
+			log.Printf("Error reading %s : %s", filePath, err)
+			return err
+		}
+	}
 
 	w.Header().Set("ETag", hash_str)
-	w.Header().Set("Content-Type", http.DetectContentType(fileContent))
-	w.Header().Set("content-length", strconv.FormatInt(fstat.Size(), 10))
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", http.DetectContentType(sniff[:n]))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("content-length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if !withBody {
+		return nil
+	}
+
+	if _, err = io.Copy(w, io.NewSectionReader(reader, offset, length)); err != nil {
+		log.Printf("Error sending %s : %s", filePath, err)
+		return err
+	}
 
 	return nil
 }
 
+// parseRange parses single range of Range header against object of given size.
+// ok is false when the header should be ignored (multiple ranges, other units),
+// valid is false when the range is not satisfiable.
+func parseRange(header string, size int64) (start int64, end int64, ok bool, valid bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, true
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+
+	var err error
+	switch {
+	case first == "":
+		// suffix range: last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, false
+		}
+		start = max(size-n, 0)
+		end = size - 1
+	default:
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 || start >= size {
+			return 0, 0, false, false
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, 0, false, false
+			}
+			end = min(end, size-1)
+		}
+	}
+
+	return start, end, true, true
+}
+
 // https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
-func listObjects(w http.ResponseWriter, r *http.Request, localPath string, bucketName string, objectKey string) (err error) {
+func listObjects(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, path string) (err error) {
 
 	var buffer bytes.Buffer
 
@@ -361,12 +1454,7 @@ func listObjects(w http.ResponseWriter, r *http.Request, localPath string, bucke
 	var common_prefixes strings.Builder
 	buffer.WriteString(s)
 
-	//	local_preffix := bucketPath + "/" + bucketName + "/"
-	local_preffix := bucketPath + "/" + bucketName + "/"
-	local_preffix = filepath.Clean(strings.TrimPrefix(local_preffix, "./"))
-
 	// Open the directory
-	path := localPath + "/" + objectKey
 	d, err := os.Open(path)
 	if err != nil {
 		if pathErr, ok := err.(*os.PathError); ok {
@@ -394,6 +1482,10 @@ func listObjects(w http.ResponseWriter, r *http.Request, localPath string, bucke
 
 	var files []fs.DirEntry
 
+	// keys of the entries are built from the key of listed directory and
+	// (decoded) entry names
+	dirKey := objectKey
+
 	if !info.IsDir() {
 		fileInfo, err := os.Stat(path)
 		if err != nil {
@@ -408,7 +1500,7 @@ func listObjects(w http.ResponseWriter, r *http.Request, localPath string, bucke
 		//we are dealing with "ls" on individual file
 		//objectKey is treated as a dir name - chop off filename
 
-		objectKey = filepath.Dir(objectKey)
+		dirKey = objectKey[:strings.LastIndex(objectKey, "/")+1]
 
 	} else {
 		// Read directory entries
@@ -419,17 +1511,13 @@ func listObjects(w http.ResponseWriter, r *http.Request, localPath string, bucke
 			return err
 		}
 
+		if dirKey != "" && !strings.HasSuffix(dirKey, "/") {
+			dirKey += "/"
+		}
 	}
 
-	// Print the names of files in the directory
-	for _, file := range files {
-		info, _ := file.Info()
-
-		fname := filepath.Clean(localPath + "/" + objectKey + "/" + file.Name())
-
-		if !file.IsDir() {
-			fname = strings.TrimPrefix(fname, local_preffix+"/")
-			var entry = fmt.Sprintf(`
+	writeContents := func(key string, info fs.FileInfo) {
+		var entry = fmt.Sprintf(`
 			<Contents>
 				<Key>%s</Key>
 				<LastModified>%s</LastModified>
@@ -441,21 +1529,49 @@ func listObjects(w http.ResponseWriter, r *http.Request, localPath string, bucke
 				</Owner>
 			</Contents>
 		
-			`, EscapeStringForXML(fname), info.ModTime().Format(time.RFC3339), info.Size(), storageClass, userId, s3user)
-			buffer.WriteString(entry)
+			`, EscapeStringForXML(key), info.ModTime().Format(time.RFC3339), objectSize(bucketName, key, info), storageClass, userId, s3user)
+		buffer.WriteString(entry)
+	}
+
+	// Print the names of files in the directory
+	for _, file := range files {
+		if isTempFile(file.Name()) {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		// object "a/b/" is stored as "a/b/.gos3rve-slash", self object of
+		// directory "a/b" is listed along with the directory itself
+		if file.Name() == slashObjectName && !file.IsDir() {
+			if dirKey != "" {
+				writeContents(dirKey, info)
+			}
+			continue
+		}
+
+		segment, ok := decodeSegment(bucketName, file.Name())
+		if !ok {
+			continue
+		}
+
+		if !file.IsDir() {
+			writeContents(dirKey+segment, info)
 		} else {
+			if self, err := os.Stat(filepath.Join(path, file.Name(), selfObjectName)); err == nil && !self.IsDir() {
+				writeContents(dirKey+segment, self)
+			}
 
-			fname = strings.TrimPrefix(fname, local_preffix)
-			if fname != "" {
-				var entry = fmt.Sprintf(`
+			var entry = fmt.Sprintf(`
 				<CommonPrefixes>
 					<Prefix>%s/</Prefix>
 				</CommonPrefixes>
-				`, EscapeStringForXML(fname))
-
-				common_prefixes.WriteString(entry)
-			}
+				`, EscapeStringForXML(dirKey+segment))
 
+			common_prefixes.WriteString(entry)
 		}
 
 	} //ls dir
@@ -491,3 +1607,179 @@ func genBase64Str(len int) string {
 
 	return base64String
 }
+
+type XmlObjectAttributesChecksum struct {
+	XmlChecksums
+	ChecksumType string `xml:"ChecksumType,omitempty"`
+}
+
+type XmlObjectAttributesPart struct {
+	XmlChecksums
+	PartNumber int   `xml:"PartNumber"`
+	Size       int64 `xml:"Size"`
+}
+
+type XmlObjectAttributesParts struct {
+	IsTruncated          bool                      `xml:"IsTruncated"`
+	MaxParts             int                       `xml:"MaxParts"`
+	NextPartNumberMarker int                       `xml:"NextPartNumberMarker"`
+	PartNumberMarker     int                       `xml:"PartNumberMarker"`
+	Parts                []XmlObjectAttributesPart `xml:"Part"`
+	PartsCount           int                       `xml:"PartsCount"`
+}
+
+type XmlGetObjectAttributesResponse struct {
+	XMLName      xml.Name                     `xml:"GetObjectAttributesResponse"`
+	ETag         string                       `xml:"ETag,omitempty"`
+	Checksum     *XmlObjectAttributesChecksum `xml:"Checksum,omitempty"`
+	ObjectParts  *XmlObjectAttributesParts    `xml:"ObjectParts,omitempty"`
+	StorageClass string                       `xml:"StorageClass,omitempty"`
+	ObjectSize   *int64                       `xml:"ObjectSize,omitempty"`
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectAttributes.html
+func getObjectAttributes(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+
+	// attributes to return are listed in x-amz-object-attributes header(s)
+	attributes := make(map[string]bool)
+	for _, value := range r.Header.Values("x-amz-object-attributes") {
+		for _, attr := range strings.Split(value, ",") {
+			attr = strings.TrimSpace(attr)
+			switch attr {
+			case "ETag", "Checksum", "ObjectParts", "StorageClass", "ObjectSize":
+				attributes[attr] = true
+			case "":
+			default:
+				s3err(w, ErrInvalidArgument)
+				return nil
+			}
+		}
+	}
+
+	if len(attributes) == 0 {
+		s3err(w, ErrInvalidArgument)
+		return nil
+	}
+
+	maxParts, partNumberMarker := 1000, 0
+	if v := r.Header.Get("x-amz-max-parts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3err(w, ErrInvalidMaxParts)
+			return nil
+		}
+		maxParts = min(n, 1000)
+	}
+	if v := r.Header.Get("x-amz-part-number-marker"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3err(w, ErrInvalidPartNumberMarker)
+			return nil
+		}
+		partNumberMarker = n
+	}
+
+	unlock := objectLocks.RLock(bucketName, objectKey)
+
+	file, err := os.Open(objectFilePath(filePath))
+	if os.IsNotExist(err) {
+		unlock()
+		s3err(w, ErrNoSuchKey)
+		return err
+	}
+	if err != nil {
+		unlock()
+		s3err(w, ErrInternalError)
+		return err
+	}
+	defer file.Close()
+
+	fstat, err := file.Stat()
+	if err != nil {
+		unlock()
+		s3err(w, ErrInternalError)
+		return err
+	}
+	if fstat.IsDir() {
+		unlock()
+		s3err(w, ErrNoSuchKey)
+		return nil
+	}
+
+	meta := loadObjectMeta(bucketName, objectKey, fstat)
+	unlock()
+
+	if code := checkSSECustomerKey(r, meta.encryption(), ssecHeaderPrefix); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	var response XmlGetObjectAttributesResponse
+
+	if attributes["ETag"] {
+		// calculating md5 is the only expensive part here, so only do it when asked
+		if response.ETag, err = objectETag(file, meta); err != nil {
+			s3err(w, ErrInternalError)
+			log.Println("Error while calculating md5 ", err.Error())
+			return err
+		}
+	}
+
+	if attributes["Checksum"] && meta != nil && meta.Checksum != "" {
+		response.Checksum = &XmlObjectAttributesChecksum{ChecksumType: meta.ChecksumType}
+		response.Checksum.Set(meta.ChecksumAlgorithm, meta.Checksum)
+	}
+
+	if attributes["ObjectParts"] && meta != nil && len(meta.Parts) > 0 {
+		parts := &XmlObjectAttributesParts{
+			MaxParts:         maxParts,
+			PartNumberMarker: partNumberMarker,
+			PartsCount:       len(meta.Parts),
+		}
+
+		for _, part := range meta.Parts {
+			if part.PartNumber <= partNumberMarker {
+				continue
+			}
+			if len(parts.Parts) == maxParts {
+				parts.IsTruncated = true
+				break
+			}
+
+			xmlPart := XmlObjectAttributesPart{PartNumber: part.PartNumber, Size: part.Size}
+			xmlPart.Set(meta.ChecksumAlgorithm, part.Checksum)
+			parts.Parts = append(parts.Parts, xmlPart)
+			parts.NextPartNumberMarker = part.PartNumber
+		}
+
+		response.ObjectParts = parts
+	}
+
+	if attributes["StorageClass"] {
+		response.StorageClass = storageClass
+		if response.StorageClass == "" {
+			response.StorageClass = "STANDARD"
+		}
+	}
+
+	if attributes["ObjectSize"] {
+		size := fstat.Size()
+		if meta != nil && meta.Encryption != nil {
+			size = meta.Encryption.Size
+		}
+		response.ObjectSize = &size
+	}
+
+	out, err := xml.Marshal(response)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Last-Modified", fstat.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+
+	return nil
+}
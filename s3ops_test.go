@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCreateBucketLocationConstraint(t *testing.T) {
+	testStorage(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(region string) { s3region = region }(s3region)
+	s3region = "eu-west-1"
+
+	for _, test := range []struct {
+		location string
+		code     int
+		error    string
+	}{
+		{"us-west-2", http.StatusBadRequest, "IllegalLocationConstraintException"},
+		{"not a region", http.StatusBadRequest, "InvalidLocationConstraint"},
+		{"eu-west-1x", http.StatusBadRequest, "InvalidLocationConstraint"},
+		{"EU", http.StatusOK, ""},
+	} {
+		body := "<CreateBucketConfiguration><LocationConstraint>" + test.location + "</LocationConstraint></CreateBucketConfiguration>"
+		w := testRequest(http.MethodPut, "/loc", []byte(body))
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.error) {
+			t.Errorf("CreateBucket in %q : %d %s", test.location, w.Code, w.Body)
+		}
+	}
+}
+
+func TestGetObjectPartNumber(t *testing.T) {
+	testStorage(t)
+
+	for _, test := range []struct {
+		body   string
+		code   int
+		cRange string
+	}{
+		{"data", http.StatusPartialContent, "bytes 0-3/4"},
+		{"", http.StatusOK, ""},
+	} {
+		if w := testRequest(http.MethodPut, "/bkt/key", []byte(test.body)); w.Code != http.StatusCreated {
+			t.Fatalf("PUT : %d %s", w.Code, w.Body)
+		}
+		w := testRequest(http.MethodGet, "/bkt/key?partNumber=1", nil)
+		if w.Code != test.code || w.Header().Get("Content-Range") != test.cRange || w.Body.String() != test.body {
+			t.Errorf("GET partNumber=1 of %d bytes : %d, Content-Range %q", len(test.body), w.Code, w.Header().Get("Content-Range"))
+		}
+	}
+}
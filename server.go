@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Listeners and graceful shutdown. On SIGTERM/SIGINT listeners stop accepting
+// connections and requests in flight get -shutdown_timeout to complete. Then
+// remaining connections are closed: uploads cut off that way fail reading
+// their body and discard their temp files, so previous versions of the
+// objects stay intact.
+
+var shutdownTimeout time.Duration
+
+// abortGracePeriod is how long handlers get to clean up once their connections are closed
+const abortGracePeriod = 5 * time.Second
+
+// activeRequests counts S3 requests being handled
+var activeRequests atomic.Int64
+
+// Names of sockets passed by systemd (FileDescriptorName=). Sockets with
+// other names are served like -p.
+const (
+	socketNameHTTPS = "https"
+	socketNameAdmin = "admin"
+)
+
+type serverListener struct {
+	server   *http.Server
+	listener net.Listener
+	tls      bool
+}
+
+func (s serverListener) run() error {
+	if s.tls {
+		return s.server.ServeTLS(s.listener, "", "")
+	}
+	return s.server.Serve(s.listener)
+}
+
+func listenPort(port int64) (net.Listener, error) {
+	return net.Listen("tcp", ":"+strconv.FormatInt(port, 10))
+}
+
+// s3Listeners returns plain and TLS listeners of S3 API, taken from systemd
+// sockets if there are any or opened on -p/-tls_port otherwise
+func s3Listeners(activated []activatedListener) (plain []net.Listener, secure []net.Listener, err error) {
+	for _, a := range activated {
+		switch {
+		case a.name == socketNameAdmin:
+		case a.name == socketNameHTTPS || (tlsEnabled() && tlsPort == 0):
+			if !tlsEnabled() {
+				return nil, nil, fmt.Errorf("socket %q passed by systemd needs TLS certificate and key file", a.name)
+			}
+			secure = append(secure, a.listener)
+		default:
+			plain = append(plain, a.listener)
+		}
+	}
+	if len(plain)+len(secure) > 0 {
+		return plain, secure, nil
+	}
+
+	if !tlsEnabled() || tlsPort != 0 {
+		listener, err := listenPort(svcPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		plain = append(plain, listener)
+	}
+	if tlsEnabled() {
+		httpsPort := svcPort
+		if tlsPort != 0 {
+			httpsPort = tlsPort
+		}
+		listener, err := listenPort(httpsPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		secure = append(secure, listener)
+	}
+	return plain, secure, nil
+}
+
+// serve runs S3 and admin listeners until one of them fails or the process is
+// asked to stop
+func serve(handler http.Handler) error {
+	activated, err := activationListeners()
+	if err != nil {
+		return err
+	}
+
+	var reloader *tlsReloader
+	if tlsEnabled() {
+		if reloader, err = newTLSReloader(); err != nil {
+			return fmt.Errorf("loading TLS certificates: %w", err)
+		}
+		activeTLS = reloader
+	}
+
+	plain, secure, err := s3Listeners(activated)
+	if err != nil {
+		return err
+	}
+
+	var listeners []serverListener
+	for _, listener := range plain {
+		server := &http.Server{Handler: handler, MaxHeaderBytes: int(maxHeaderSize)}
+		listeners = append(listeners, serverListener{server: server, listener: listener})
+		log.Printf("S3 server is running on %s ...", listener.Addr())
+	}
+	for _, listener := range secure {
+		server := &http.Server{
+			Handler:        handler,
+			MaxHeaderBytes: int(maxHeaderSize),
+			TLSConfig:      &tls.Config{GetConfigForClient: reloader.getConfigForClient},
+		}
+		listeners = append(listeners, serverListener{server: server, listener: listener, tls: true})
+		log.Printf("S3 server is running on %s (HTTPS) ...", listener.Addr())
+	}
+	if tlsClientCAPath != "" {
+		log.Printf("client certificates verified against %s ...", tlsClientCAPath)
+	}
+
+	var adminListener net.Listener
+	for _, a := range activated {
+		if a.name == socketNameAdmin {
+			adminListener = a.listener
+		}
+	}
+	if adminListener == nil && adminPort != 0 {
+		if adminListener, err = listenPort(adminPort); err != nil {
+			return fmt.Errorf("admin listener : %w", err)
+		}
+	}
+	if adminListener != nil {
+		listeners = append(listeners, serverListener{server: startAdminListener(adminListener), listener: adminListener})
+	}
+
+	if len(activated) > 0 {
+		log.Printf("systemd socket activation  %d sockets ...", len(activated))
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- l.run()
+		}()
+	}
+
+	sdNotify("READY=1")
+	startWatchdog()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case err = <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadConfig()
+				continue
+			}
+			log.Printf("Received %s, shutting down ...", sig)
+			shutdown(listeners)
+			return nil
+		}
+	}
+}
+
+// shutdown stops listeners, waits for requests in flight and flushes access logs
+func shutdown(listeners []serverListener) {
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.server.Shutdown(ctx); err != nil {
+				l.server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := activeRequests.Load(); n > 0 {
+		log.Printf("Aborting %d requests still in flight after %s", n, shutdownTimeout)
+		deadline := time.Now().Add(abortGracePeriod)
+		for activeRequests.Load() > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	flushAccessLogs()
+}
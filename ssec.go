@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+// Server-side encryption with customer-provided keys (SSE-C)
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/ServerSideEncryptionCustomerKeys.html
+//
+// The key sent with the request encrypts the object directly (in the same
+// chunked format as objects encrypted with server's keys) and is never stored.
+// Metadata keeps MD5 of the key (returned in responses) and its salted
+// HMAC-SHA256, which is used to check keys of later requests.
+
+const (
+	ssecHeaderPrefix     = "x-amz-server-side-encryption-customer-"
+	ssecCopySourcePrefix = "x-amz-copy-source-server-side-encryption-customer-"
+)
+
+var ssecAllowHTTP bool // accept SSE-C keys over plain HTTP (e.g. TLS terminated by a proxy)
+
+// parseSSECustomerKey returns customer key sent in SSE-C headers with given
+// prefix (nil if there are none)
+func parseSSECustomerKey(r *http.Request, prefix string) ([]byte, ErrorCode) {
+	algorithm := r.Header.Get(prefix + "algorithm")
+	encodedKey := r.Header.Get(prefix + "key")
+	keyMD5 := r.Header.Get(prefix + "key-MD5")
+	if algorithm == "" && encodedKey == "" && keyMD5 == "" {
+		return nil, ErrNone
+	}
+
+	// keys must not travel in clear text
+	if r.TLS == nil && !ssecAllowHTTP {
+		return nil, ErrInsecureSSECustomerRequest
+	}
+
+	if algorithm != sseAlgorithmAES256 {
+		return nil, ErrInvalidEncryptionAlgorithm
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, ErrSSECustomerKeyInvalid
+	}
+
+	sum := md5.Sum(key)
+	if keyMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, ErrSSECustomerKeyInvalid
+	}
+
+	return key, ErrNone
+}
+
+func customerKeyHash(salt []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// newCustomerEncryption describes object encrypted with customer key
+func newCustomerEncryption(key []byte) (*ObjectEncryption, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	sum := md5.Sum(key)
+	return &ObjectEncryption{
+		Algorithm:       sseAlgorithmAES256,
+		CustomerKeyMD5:  base64.StdEncoding.EncodeToString(sum[:]),
+		CustomerKeySalt: base64.StdEncoding.EncodeToString(salt),
+		CustomerKeyHash: base64.StdEncoding.EncodeToString(customerKeyHash(salt, key)),
+		customerKey:     key,
+	}, nil
+}
+
+func (e *ObjectEncryption) isCustomerKey() bool {
+	return e != nil && e.CustomerKeyHash != ""
+}
+
+func (e *ObjectEncryption) matchesCustomerKey(key []byte) bool {
+	salt, err := base64.StdEncoding.DecodeString(e.CustomerKeySalt)
+	if err != nil {
+		return false
+	}
+	expected, err := base64.StdEncoding.DecodeString(e.CustomerKeyHash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(customerKeyHash(salt, key), expected)
+}
+
+// checkSSECustomerKey validates SSE-C headers (with given prefix) of request
+// reading data encrypted as described by enc (nil for plain data). Matching
+// key is remembered in enc for decryption.
+func checkSSECustomerKey(r *http.Request, enc *ObjectEncryption, prefix string) ErrorCode {
+	key, code := parseSSECustomerKey(r, prefix)
+	if code != ErrNone {
+		return code
+	}
+
+	if !enc.isCustomerKey() {
+		if key != nil {
+			return ErrSSECustomerNotApplicable
+		}
+		return ErrNone
+	}
+
+	if key == nil {
+		return ErrSSECustomerKeyMissing
+	}
+	if !enc.matchesCustomerKey(key) {
+		return ErrSSECustomerKeyMismatch
+	}
+
+	enc.customerKey = key
+	return ErrNone
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemd integration: readiness and watchdog notifications (Type=notify,
+// WatchdogSec=) and socket activation (LISTEN_FDS). All of it is a no-op
+// when the server is not started by systemd.
+// https://www.freedesktop.org/software/systemd/man/sd_notify.html
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+
+// listenFdsStart is the first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+// sdNotify sends state (e.g. "READY=1") to the service manager
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Error notifying systemd (%s) : %s", state, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd (%s) : %s", state, err)
+	}
+}
+
+// watchdogInterval returns how often the watchdog must be pinged (0 if not enabled)
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings systemd watchdog twice per WatchdogSec
+func startWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			sdNotify("WATCHDOG=1")
+			time.Sleep(interval / 2)
+		}
+	}()
+	log.Printf("systemd watchdog  %s ...", interval)
+}
+
+// activatedListener is a socket passed by systemd with its FileDescriptorName
+type activatedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// activationListeners returns sockets passed by systemd socket activation
+func activationListeners() ([]activatedListener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []activatedListener
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) passed by systemd : %w", listenFdsStart+i, name, err)
+		}
+		listeners = append(listeners, activatedListener{name: name, listener: listener})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Object and bucket tagging
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-tagging.html
+
+const (
+	maxObjectTags     = 10
+	maxBucketTags     = 50
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+var tagCharsPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+type XmlTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type XmlTagSet struct {
+	Tags []XmlTag `xml:"Tag"`
+}
+
+type XmlTagging struct {
+	XMLName xml.Name  `xml:"Tagging"`
+	Xmlns   string    `xml:"xmlns,attr,omitempty"`
+	TagSet  XmlTagSet `xml:"TagSet"`
+}
+
+// validateTags checks tag set against S3 limits
+func validateTags(tags []XmlTag, limit int) ErrorCode {
+	if len(tags) > limit {
+		return ErrInvalidTag
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		keyLen, valueLen := utf8.RuneCountInString(tag.Key), utf8.RuneCountInString(tag.Value)
+		if keyLen == 0 || keyLen > maxTagKeyLength || valueLen > maxTagValueLength {
+			return ErrInvalidTag
+		}
+		if !tagCharsPattern.MatchString(tag.Key) || !tagCharsPattern.MatchString(tag.Value) {
+			return ErrInvalidTag
+		}
+		// aws: prefix is reserved
+		if strings.HasPrefix(strings.ToLower(tag.Key), "aws:") || seen[tag.Key] {
+			return ErrInvalidTag
+		}
+		seen[tag.Key] = true
+	}
+
+	return ErrNone
+}
+
+func tagsToMap(tags []XmlTag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[tag.Key] = tag.Value
+	}
+	return m
+}
+
+func tagsFromMap(m map[string]string) []XmlTag {
+	tags := make([]XmlTag, 0, len(m))
+	for key, value := range m {
+		tags = append(tags, XmlTag{Key: key, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags
+}
+
+// parseTaggingHeader parses x-amz-tagging header (URL query encoded
+// "key1=value1&key2=value2") of PutObject, CopyObject and CreateMultipartUpload
+func parseTaggingHeader(r *http.Request) (map[string]string, ErrorCode) {
+	header := r.Header.Get("x-amz-tagging")
+	if header == "" {
+		return nil, ErrNone
+	}
+
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return nil, ErrInvalidTag
+	}
+
+	var tags []XmlTag
+	for key, list := range values {
+		if len(list) != 1 {
+			return nil, ErrInvalidTag
+		}
+		tags = append(tags, XmlTag{Key: key, Value: list[0]})
+	}
+
+	if code := validateTags(tags, maxObjectTags); code != ErrNone {
+		return nil, code
+	}
+
+	return tagsToMap(tags), ErrNone
+}
+
+// objectTags returns tags of the object (nil if it has none)
+func objectTags(bucketName string, objectKey string, filePath string) map[string]string {
+	fstat, err := os.Stat(objectFilePath(filePath))
+	if err != nil || fstat.IsDir() {
+		return nil
+	}
+	if meta := loadObjectMeta(bucketName, objectKey, fstat); meta != nil {
+		return meta.Tags
+	}
+	return nil
+}
+
+// updateObjectTags replaces tags of existing object, metadata record is
+// created for objects which have none
+func updateObjectTags(bucketName string, objectKey string, filePath string, tags map[string]string) ErrorCode {
+	unlock := objectLocks.Lock(bucketName, objectKey)
+	defer unlock()
+
+	fstat, err := os.Stat(objectFilePath(filePath))
+	if err != nil || fstat.IsDir() || isDirKey(objectKey) {
+		return ErrNoSuchKey
+	}
+
+	meta := loadObjectMeta(bucketName, objectKey, fstat)
+	if meta == nil {
+		meta = &ObjectMeta{}
+	}
+	meta.Tags = tags
+
+	if err = saveObjectMeta(bucketName, objectKey, meta, fstat); err != nil {
+		log.Printf("Error saving tags of %s/%s : %s", bucketName, objectKey, err)
+		return ErrInternalError
+	}
+
+	return ErrNone
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObjectTagging.html
+func putObjectTagging(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var tagging XmlTagging
+	if err = xml.Unmarshal(body, &tagging); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	if code := validateTags(tagging.TagSet.Tags, maxObjectTags); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	if code := updateObjectTags(bucketName, objectKey, filePath, tagsToMap(tagging.TagSet.Tags)); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectTagging.html
+func getObjectTagging(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	unlock := objectLocks.RLock(bucketName, objectKey)
+	fstat, err := os.Stat(objectFilePath(filePath))
+	var meta *ObjectMeta
+	if err == nil && !fstat.IsDir() {
+		meta = loadObjectMeta(bucketName, objectKey, fstat)
+	}
+	unlock()
+
+	if err != nil || fstat.IsDir() {
+		s3err(w, ErrNoSuchKey)
+		return nil
+	}
+
+	response := XmlTagging{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	if meta != nil {
+		response.TagSet.Tags = tagsFromMap(meta.Tags)
+	}
+
+	return writeXML(w, response)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteObjectTagging.html
+func deleteObjectTagging(w http.ResponseWriter, r *http.Request, bucketName string, objectKey string, filePath string) error {
+	if code := updateObjectTags(bucketName, objectKey, filePath, nil); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketTagging.html
+func putBucketTagging(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3err(w, ErrInternalError)
+		return err
+	}
+
+	var tagging XmlTagging
+	if err = xml.Unmarshal(body, &tagging); err != nil {
+		s3err(w, ErrMalformedXML)
+		return nil
+	}
+
+	if code := validateTags(tagging.TagSet.Tags, maxBucketTags); code != ErrNone {
+		s3err(w, code)
+		return nil
+	}
+
+	err = updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Tags = tagsToMap(tagging.TagSet.Tags)
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error saving tags of bucket %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketTagging.html
+func getBucketTagging(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	tags := loadBucketMeta(bucketName).Tags
+	if len(tags) == 0 {
+		s3err(w, ErrNoSuchTagSet)
+		return nil
+	}
+
+	response := XmlTagging{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	response.TagSet.Tags = tagsFromMap(tags)
+	return writeXML(w, response)
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketTagging.html
+func deleteBucketTagging(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	err := updateBucketMeta(bucketName, func(meta *BucketMeta) {
+		meta.Tags = nil
+	})
+	if err != nil {
+		s3err(w, ErrInternalError)
+		log.Printf("Error removing tags of bucket %s : %s", bucketName, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HTTPS listener. With -tls_port the server listens for HTTP on -p and for
+// HTTPS on -tls_port, otherwise -p serves HTTPS only. Certificate files are
+// checked for changes on new connections (at most every tlsReloadInterval),
+// so renewed certificates are picked up without restart.
+
+var (
+	tlsCertPath     string
+	tlsKeyPath      string
+	tlsClientCAPath string // clients must present a certificate signed by one of these CAs
+	tlsPort         int64
+)
+
+const tlsReloadInterval = 10 * time.Second
+
+// activeTLS is the configuration of the running HTTPS listeners
+var activeTLS *tlsReloader
+
+func tlsEnabled() bool {
+	return tlsCertPath != ""
+}
+
+type tlsReloader struct {
+	mu       sync.Mutex
+	config   *tls.Config
+	modTimes []time.Time
+	checked  time.Time
+}
+
+func newTLSReloader() (*tlsReloader, error) {
+	reloader := &tlsReloader{checked: time.Now()}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (t *tlsReloader) files() []string {
+	files := []string{tlsCertPath, tlsKeyPath}
+	if tlsClientCAPath != "" {
+		files = append(files, tlsClientCAPath)
+	}
+	return files
+}
+
+func fileModTimes(paths []string) []time.Time {
+	times := make([]time.Time, len(paths))
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func (t *tlsReloader) load() error {
+	modTimes := fileModTimes(t.files())
+
+	cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if tlsClientCAPath != "" {
+		data, err := os.ReadFile(tlsClientCAPath)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", tlsClientCAPath)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	t.config = config
+	t.modTimes = modTimes
+	return nil
+}
+
+// getConfigForClient returns current TLS configuration, reloading it first
+// if certificate files have changed. Broken files (e.g. cert and key being
+// replaced one by one) keep the old configuration until the next check.
+func (t *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checked) >= tlsReloadInterval {
+		t.checked = time.Now()
+		if !slices.EqualFunc(fileModTimes(t.files()), t.modTimes, time.Time.Equal) {
+			if err := t.load(); err != nil {
+				log.Printf("Error reloading TLS certificates (keeping the old ones) : %s", err)
+			} else {
+				log.Printf("TLS certificates reloaded from %s", tlsCertPath)
+			}
+		}
+	}
+
+	return t.config, nil
+}
+
+// reload switches to (possibly different) certificate files right away
+func (t *tlsReloader) reload(certPath string, keyPath string, clientCAPath string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldCertPath, oldKeyPath, oldClientCAPath := tlsCertPath, tlsKeyPath, tlsClientCAPath
+	tlsCertPath, tlsKeyPath, tlsClientCAPath = certPath, keyPath, clientCAPath
+	if err := t.load(); err != nil {
+		tlsCertPath, tlsKeyPath, tlsClientCAPath = oldCertPath, oldKeyPath, oldClientCAPath
+		return err
+	}
+	t.checked = time.Now()
+	log.Printf("TLS certificates reloaded from %s", tlsCertPath)
+	return nil
+}
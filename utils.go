@@ -436,8 +436,19 @@ func getContentSha256Cksum(r *http.Request) string {
 	return defaultSha256Cksum
 }
 
+// authentication failures
+var (
+	errAuthMalformed         = errors.New("prob parsing v4 signature")
+	errAuthSignedHeaders     = errors.New("prob extracting headers")
+	errAuthUnknownKey        = errors.New("bad key")
+	errAuthMissingDate       = errors.New("ErrMissingDateHeader")
+	errAuthMalformedDate     = errors.New("ErrMalformedDate")
+	errAuthSignatureMismatch = errors.New("ErrSignatureDoesNotMatch")
+)
+
 // Verify authorization header - http://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
-func authenticate(r *http.Request) (bool, error) {
+// Returns identity the request has been signed with.
+func authenticate(r *http.Request) (*s3Identity, error) {
 
 	hashedPayload := getContentSha256Cksum(r)
 
@@ -450,17 +461,18 @@ func authenticate(r *http.Request) (bool, error) {
 	// Parse signature version '4' header.
 	signV4Values, err := parseSignV4(v4Auth)
 	if err != ErrNone {
-		return false, errors.New("prob parsing v4 signature")
+		return nil, errAuthMalformed
 	}
 
 	// Extract all the signed headers along with its values.
 	extractedSignedHeaders, errCode := extractSignedHeaders(signV4Values.SignedHeaders, r)
 	if errCode != ErrNone {
-		return false, errors.New("prob extracting headers")
+		return nil, errAuthSignedHeaders
 	}
 
-	if signV4Values.Credential.accessKey != keyId {
-		return false, errors.New("bad key")
+	identity := lookupIdentity(signV4Values.Credential.accessKey)
+	if identity == nil {
+		return nil, errAuthUnknownKey
 	}
 
 	// Extract date, if not present throw error.
@@ -468,21 +480,21 @@ func authenticate(r *http.Request) (bool, error) {
 	if date = req.Header.Get(http.CanonicalHeaderKey("X-Amz-Date")); date == "" {
 		if date = r.Header.Get("Date"); date == "" {
 			// return nil, s3err.ErrMissingDateHeader
-			return false, errors.New("ErrMissingDateHeader")
+			return nil, errAuthMissingDate
 		}
 	}
 	// Parse date header.
 	t, e := time.Parse(iso8601Format, date)
 	if e != nil {
-		return false, errors.New("ErrMalformedDate")
+		return nil, errAuthMalformedDate
 
 		// return nil, s3err.ErrMalformedDate
 	}
 
 	var cred credentialHeader
 
-	cred.accessKey = keyId
-	cred.SecretKey = secretKey
+	cred.accessKey = identity.AccessKeyId
+	cred.SecretKey = identity.SecretAccessKey
 	cred.scope.region = s3region
 	cred.scope.service = "s3"
 	cred.scope.request = "aws4_request"
@@ -503,7 +515,7 @@ func authenticate(r *http.Request) (bool, error) {
 	}
 
 	// Get canonical request.
-	canonicalRequest := getCanonicalRequest(extractedSignedHeaders, hashedPayload, queryStr, req.URL.Path, req.Method)
+	canonicalRequest := getCanonicalRequest(extractedSignedHeaders, hashedPayload, queryStr, signedPath(r), req.Method)
 
 	// Get string to sign from canonical request.
 	stringToSign := getStringToSign(canonicalRequest, t, signV4Values.Credential.getScope())
@@ -523,13 +535,13 @@ func authenticate(r *http.Request) (bool, error) {
 
 	// Verify if signature match.
 	if !compareSignatureV4(newSignature, signV4Values.Signature) {
-		return false, errors.New("ErrSignatureDoesNotMatch")
+		return nil, errAuthSignatureMismatch
 
 		// return nil, s3err.ErrSignatureDoesNotMatch
 	}
 
 	// Return error none.
-	return true, nil
+	return identity, nil
 }
 
 // compareSignatureV4 returns true if and only if both signatures
@@ -627,7 +639,9 @@ func extractBucketAndKey(r *http.Request) (string, string, map[string]string) {
 
 	params := make(map[string]string)
 
-	if key == "" && query != "" {
+	// prefix of ListObjects, other methods on the bucket don't take a key
+	// from the query
+	if key == "" && query != "" && isListMethod(r) {
 		tokens := strings.Split(query, "&")
 
 		for _, arg := range tokens {
@@ -649,3 +663,8 @@ func extractBucketAndKey(r *http.Request) (string, string, map[string]string) {
 
 	return bucket, key, params
 }
+
+// isListMethod reports whether request method may list objects of a bucket
+func isListMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
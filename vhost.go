@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Virtual-hosted-style requests (<bucket>.<domain>/<key>) are rewritten into
+// path style (/<bucket>/<key>) before they are handled. Requests to the
+// domains themselves, or to hosts outside of them, stay in path style.
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/VirtualHosting.html
+
+var (
+	vhostDomainList string
+	vhostDomains    []string
+)
+
+type signedPathCtxKey struct{}
+
+// parseVHostDomains parses comma-separated list of base domains
+func parseVHostDomains(list string) []string {
+	var domains []string
+	for _, domain := range strings.Split(list, ",") {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// vhostBucket returns bucket name encoded in host (empty for path style)
+func vhostBucket(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// the longest matching domain wins ("s3.example.com" over "example.com")
+	bucket := ""
+	matched := 0
+	for _, domain := range vhostDomains {
+		if len(domain) <= matched {
+			continue
+		}
+		if host == domain {
+			bucket, matched = "", len(domain)
+		} else if strings.HasSuffix(host, "."+domain) {
+			bucket, matched = strings.TrimSuffix(host, "."+domain), len(domain)
+		}
+	}
+	return bucket
+}
+
+// withVirtualHost rewrites virtual-hosted-style request into path style,
+// original path is kept for signature verification
+func withVirtualHost(r *http.Request) *http.Request {
+	if len(vhostDomains) == 0 {
+		return r
+	}
+
+	bucket := vhostBucket(r.Host)
+	if bucket == "" {
+		return r
+	}
+
+	u := *r.URL
+	u.Path = "/" + bucket + r.URL.Path
+	if u.RawPath != "" {
+		u.RawPath = "/" + bucket + r.URL.RawPath
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), signedPathCtxKey{}, r.URL.Path))
+	r.URL = &u
+	return r
+}
+
+// signedPath returns path of the request as sent by the client
+func signedPath(r *http.Request) string {
+	if path, ok := r.Context().Value(signedPathCtxKey{}).(string); ok {
+		return path
+	}
+	return r.URL.Path
+}